@@ -3,11 +3,76 @@ package cache
 import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/devingen/sepet-cdn/model"
+	"time"
 )
 
 // IFileCache defines the functionality of the file cache
 type IFileCache interface {
+	// GetFile returns the file if it's cached and not expired
 	GetFile(path string) ([]byte, *s3.GetObjectOutput, bool)
+
+	// GetStaleFile returns the file if it's cached even if it's expired. The returned duration is how long ago
+	// the file expired and it's 0 for the files that are not expired.
+	GetStaleFile(path string) ([]byte, *s3.GetObjectOutput, time.Duration, bool)
+
 	SaveFile(path string, data *s3.GetObjectOutput, buff []byte)
-	Invalidate(buckets []*model.Bucket)
+
+	// GetFileVariant returns the encoded variant of the cached file like its gzip compressed content.
+	// The variant is returned only if the cached file still has the given meta.
+	GetFileVariant(path string, meta *s3.GetObjectOutput, encoding string) ([]byte, bool)
+
+	// SaveFileVariant saves the encoded variant of the cached file next to its content. It's ignored if the
+	// file is not cached or the cached file doesn't have the given meta anymore.
+	SaveFileVariant(path string, meta *s3.GetObjectOutput, encoding string, buff []byte)
+
+	// GetFileChunk returns the chunk of a large file that's cached in fixed-size parts if it's cached and not
+	// expired. The meta is the meta of the ranged request that returned the chunk.
+	GetFileChunk(path string, index int64) ([]byte, *s3.GetObjectOutput, bool)
+
+	// SaveFileChunk saves the chunk of the file at the given index. The chunks are removed with the file
+	// when the file is purged.
+	SaveFileChunk(path string, index int64, meta *s3.GetObjectOutput, buff []byte)
+
+	// SaveMissingFile records that the file is not found and removes the file if it's cached
+	SaveMissingFile(path string)
+
+	// IsFileMissing returns true if the file is recently recorded as not found
+	IsFileMissing(path string) bool
+
+	// SaveLargeFile records that the file is too large to be cached and removes the file if it's cached
+	SaveLargeFile(path string)
+
+	// IsFileTooLarge returns true if the file is recently recorded as too large to be cached
+	IsFileTooLarge(path string) bool
+
+	// SetQuotas sets the cache size limits of the buckets that have them. The files of the buckets that exceed
+	// their new limits are evicted.
+	SetQuotas(buckets []*model.Bucket)
+
+	// Purge removes the file with the exact path or all the files starting with the path if isPrefix is true
+	Purge(path string, isPrefix bool) PurgeResult
+}
+
+// IExpiringFileCache defines the functionality of getting and saving the files with their expiry times. It's
+// used to copy the files between the caches without renewing their expiries.
+type IExpiringFileCache interface {
+	// GetFileWithExpiry returns the file and the time it expires if it's cached and not expired
+	GetFileWithExpiry(path string) ([]byte, *s3.GetObjectOutput, time.Time, bool)
+
+	// SaveFileWithExpiry saves the file to expire at the given time instead of the expiry of its meta
+	SaveFileWithExpiry(path string, data *s3.GetObjectOutput, buff []byte, expiresAt time.Time)
+}
+
+// PurgeResult contains the number of the entries and the bytes removed from the cache
+type PurgeResult struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Add returns the sum of the purge results
+func (r PurgeResult) Add(other PurgeResult) PurgeResult {
+	return PurgeResult{
+		Entries: r.Entries + other.Entries,
+		Bytes:   r.Bytes + other.Bytes,
+	}
 }
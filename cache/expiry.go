@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	core "github.com/devingen/api-core"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetExpiry returns the time when the cached file becomes stale by using the Cache-Control and Expires
+// headers of the file. The 's-maxage' and 'max-age' directives take precedence over the Expires header.
+// Files with 'no-cache' or 'no-store' directives expire immediately, IsStorable tells whether the file can be
+// stored at all. Returns the zero time if the file doesn't define an expiry, which means the file is kept
+// until it's removed from the cache.
+func GetExpiry(meta *s3.GetObjectOutput, now time.Time) time.Time {
+	if meta == nil {
+		return time.Time{}
+	}
+
+	maxAge := int64(-1)
+	sharedMaxAge := int64(-1)
+	for _, directive := range strings.Split(core.StringValue(meta.CacheControl), ",") {
+		name, value := parseDirective(directive)
+		switch name {
+		case "no-cache", "no-store":
+			return now
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sharedMaxAge = parseSeconds(value)
+		}
+	}
+
+	if sharedMaxAge >= 0 {
+		return now.Add(time.Duration(sharedMaxAge) * time.Second)
+	}
+	if maxAge >= 0 {
+		return now.Add(time.Duration(maxAge) * time.Second)
+	}
+
+	if meta.Expires != nil {
+		expires, err := http.ParseTime(*meta.Expires)
+		if err != nil {
+			// invalid dates like '0' represent a time in the past
+			return now
+		}
+		return expires
+	}
+	return time.Time{}
+}
+
+// IsStorable returns false if the Cache-Control header of the file forbids the shared caches to store it
+// with the 'no-store' or 'private' directives
+func IsStorable(meta *s3.GetObjectOutput) bool {
+	if meta == nil {
+		return true
+	}
+
+	for _, directive := range strings.Split(core.StringValue(meta.CacheControl), ",") {
+		name, _ := parseDirective(directive)
+		switch name {
+		case "no-store", "private":
+			return false
+		}
+	}
+	return true
+}
+
+// GetStaleness returns how long ago the file expired. Returns 0 for the files that are not expired.
+// The files with zero expiry time never expire.
+func GetStaleness(expiresAt, now time.Time) time.Duration {
+	if expiresAt.IsZero() || now.Before(expiresAt) {
+		return 0
+	}
+	if staleness := now.Sub(expiresAt); staleness > 0 {
+		return staleness
+	}
+	// the file expires at this exact moment
+	return time.Nanosecond
+}
+
+// parseDirective splits a Cache-Control directive like 'max-age=60' into its name and value
+func parseDirective(directive string) (string, string) {
+	directive = strings.TrimSpace(directive)
+	equalIndex := strings.IndexByte(directive, '=')
+	if equalIndex < 0 {
+		return strings.ToLower(directive), ""
+	}
+	return strings.ToLower(strings.TrimSpace(directive[:equalIndex])), strings.Trim(strings.TrimSpace(directive[equalIndex+1:]), "\"")
+}
+
+// parseSeconds returns the delta seconds value of a directive or 0 if the value is invalid
+func parseSeconds(value string) int64 {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGetExpiry(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t,
+		time.Time{},
+		GetExpiry(&s3.GetObjectOutput{}, now),
+		"file without cache headers must not expire",
+	)
+	assert.Equal(t,
+		now.Add(30*time.Second),
+		GetExpiry(&s3.GetObjectOutput{CacheControl: aws.String("public, max-age=30")}, now),
+		"incorrect max-age expiry",
+	)
+	assert.Equal(t,
+		now.Add(24*time.Hour),
+		GetExpiry(&s3.GetObjectOutput{CacheControl: aws.String("max-age=30, s-maxage=86400")}, now),
+		"s-maxage must take precedence over max-age",
+	)
+	assert.Equal(t,
+		now,
+		GetExpiry(&s3.GetObjectOutput{CacheControl: aws.String("no-cache")}, now),
+		"no-cache must expire immediately",
+	)
+	assert.Equal(t,
+		now.Add(time.Minute),
+		GetExpiry(&s3.GetObjectOutput{
+			CacheControl: aws.String("max-age=60"),
+			Expires:      aws.String("Thu, 01 Jan 1970 00:00:00 GMT"),
+		}, now),
+		"max-age must take precedence over Expires",
+	)
+	assert.Equal(t,
+		time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		GetExpiry(&s3.GetObjectOutput{Expires: aws.String("Sat, 02 Jan 2021 00:00:00 GMT")}, now).UTC(),
+		"incorrect Expires expiry",
+	)
+	assert.Equal(t,
+		now,
+		GetExpiry(&s3.GetObjectOutput{Expires: aws.String("0")}, now),
+		"invalid Expires must expire immediately",
+	)
+}
+
+func TestIsStorable(t *testing.T) {
+	assert.True(t, IsStorable(&s3.GetObjectOutput{}), "file without cache headers must be stored")
+	assert.True(t, IsStorable(&s3.GetObjectOutput{CacheControl: aws.String("public, max-age=30")}), "public file must be stored")
+	assert.True(t, IsStorable(&s3.GetObjectOutput{CacheControl: aws.String("no-cache")}), "no-cache file must be stored to be revalidated")
+	assert.False(t, IsStorable(&s3.GetObjectOutput{CacheControl: aws.String("no-store")}), "no-store file must not be stored")
+	assert.False(t, IsStorable(&s3.GetObjectOutput{CacheControl: aws.String("max-age=60, Private")}), "private file must not be stored")
+	assert.False(t, IsStorable(&s3.GetObjectOutput{CacheControl: aws.String(`private="set-cookie"`)}), "private file must not be stored")
+}
@@ -0,0 +1,586 @@
+package filediskcache
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentExtension = ".content"
+	metaExtension    = ".meta"
+	tmpExtension     = ".tmp"
+)
+
+// FileDiskCache implements IFileCache interface with local disk storage. The content and the metadata
+// of each file are kept in separate files named after the hash of the file path and a random suffix.
+type FileDiskCache struct {
+	logger *logrus.Logger
+	dir    string
+
+	// maxBytes is the total content size limit of the cache. Zero means unlimited.
+	maxBytes int64
+
+	// maxAge is how long the files are served before they're revalidated, even if they don't expire. The disk
+	// outlives the memory cache that's reset periodically, so the files are refetched at least as often. Zero
+	// means unlimited.
+	maxAge time.Duration
+
+	// lock guards the usage list, the usage elements, the used bytes and the quotas. The files are read and
+	// written without holding it.
+	lock sync.Mutex
+
+	// usage keeps the cached files ordered by their last access, the most recently used file is at the front
+	usage *list.List
+
+	// usageElements maps the file paths to their elements in the usage list
+	usageElements map[string]*list.Element
+
+	// usedBytes is the total content size of the cached files
+	usedBytes int64
+
+	// quotas are the cache size limits of the buckets by their folders
+	quotas map[string]int64
+
+	// folderBytes is the total content size of the cached files by their bucket folders
+	folderBytes map[string]int64
+
+	// bucketRevisions are the revisions of the buckets by their folders. They're recorded with the files to
+	// remove the files of the buckets that are changed while the server is down.
+	bucketRevisions map[string]int
+}
+
+// usageItem is the value of the usage list elements
+type usageItem struct {
+	path           string
+	name           string
+	size           int64
+	expiresAt      time.Time
+	bucketRevision int
+}
+
+// diskMeta is the structure of the metadata files. The file meta is serialized with cache.MarshalMeta.
+type diskMeta struct {
+	Path           string          `json:"path"`
+	ExpiresAt      time.Time       `json:"expiresAt"`
+	BucketRevision int             `json:"bucketRevision"`
+	Meta           json.RawMessage `json:"meta"`
+}
+
+// New creates the cache directory if it doesn't exist and loads the files that are already in it. The files of
+// the changed buckets must be removed with RemoveFilesOfChangedBuckets once the buckets are known.
+func New(ctx context.Context, dir string, maxBytes int64, maxAge time.Duration) (*FileDiskCache, error) {
+	logger, err := log.Of(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	cache := &FileDiskCache{
+		logger:          logger,
+		dir:             dir,
+		maxBytes:        maxBytes,
+		maxAge:          maxAge,
+		usage:           list.New(),
+		usageElements:   map[string]*list.Element{},
+		quotas:          map[string]int64{},
+		folderBytes:     map[string]int64{},
+		bucketRevisions: map[string]int{},
+	}
+
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (dc *FileDiskCache) GetFile(path string) ([]byte, *s3.GetObjectOutput, bool) {
+	buff, meta, _, hasCache := dc.GetFileWithExpiry(path)
+	return buff, meta, hasCache
+}
+
+// GetFileWithExpiry implements IExpiringFileCache interface
+func (dc *FileDiskCache) GetFileWithExpiry(path string) ([]byte, *s3.GetObjectOutput, time.Time, bool) {
+	buff, meta, expiresAt, staleness, hasCache := dc.getFile(path, false)
+	if !hasCache || staleness > 0 {
+		return nil, nil, time.Time{}, false
+	}
+	return buff, meta, expiresAt, true
+}
+
+func (dc *FileDiskCache) GetStaleFile(path string) ([]byte, *s3.GetObjectOutput, time.Duration, bool) {
+	buff, meta, _, staleness, hasCache := dc.getFile(path, true)
+	return buff, meta, staleness, hasCache
+}
+
+// getFile reads the file from the disk without holding the lock. The files of a version are never overwritten,
+// so the file is either read completely or not found if it's removed in the meantime.
+func (dc *FileDiskCache) getFile(path string, allowStale bool) ([]byte, *s3.GetObjectOutput, time.Time, time.Duration, bool) {
+	dc.lock.Lock()
+	element, exists := dc.usageElements[path]
+	if !exists {
+		dc.lock.Unlock()
+		return nil, nil, time.Time{}, 0, false
+	}
+	item := element.Value.(*usageItem)
+
+	staleness := cache.GetStaleness(item.expiresAt, time.Now())
+	if staleness > 0 && !allowStale {
+		// keep the file to be revalidated or served as stale, don't read it from the disk
+		dc.lock.Unlock()
+		return nil, nil, time.Time{}, 0, false
+	}
+	dc.usage.MoveToFront(element)
+	dc.lock.Unlock()
+
+	meta, err := dc.readMeta(item.name)
+	if err != nil {
+		dc.removeUnreadable(element, "reading-file-meta-from-disk-failed", err)
+		return nil, nil, time.Time{}, 0, false
+	}
+	fileMeta, err := cache.UnmarshalMeta(meta.Meta)
+	if err != nil {
+		dc.removeUnreadable(element, "reading-file-meta-from-disk-failed", err)
+		return nil, nil, time.Time{}, 0, false
+	}
+
+	buff, err := ioutil.ReadFile(dc.filePath(item.name, contentExtension))
+	if err != nil {
+		dc.removeUnreadable(element, "reading-file-content-from-disk-failed", err)
+		return nil, nil, time.Time{}, 0, false
+	}
+
+	dc.logger.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("got-file-from-disk-cache")
+
+	return buff, fileMeta, item.expiresAt, staleness, true
+}
+
+// removeUnreadable removes the file that can't be read from the disk. The error is ignored if the file is
+// removed or replaced while it's being read.
+func (dc *FileDiskCache) removeUnreadable(element *list.Element, message string, err error) {
+	item := element.Value.(*usageItem)
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if dc.usageElements[item.path] != element {
+		return
+	}
+
+	dc.logger.WithFields(logrus.Fields{
+		"path":  item.path,
+		"error": err.Error(),
+	}).Error(message)
+	dc.remove(item.path)
+}
+
+func (dc *FileDiskCache) SaveFile(path string, data *s3.GetObjectOutput, buff []byte) {
+	dc.SaveFileWithExpiry(path, data, buff, cache.GetExpiry(data, time.Now()))
+}
+
+// SaveFileWithExpiry implements IExpiringFileCache interface. The files are written without holding the lock
+// into new files of the version and they replace the previous version under the lock.
+func (dc *FileDiskCache) SaveFileWithExpiry(path string, data *s3.GetObjectOutput, buff []byte, expiresAt time.Time) {
+	if !cache.IsStorable(data) {
+		// the previous version of the file must not be served anymore
+		dc.lock.Lock()
+		dc.remove(path)
+		dc.lock.Unlock()
+		return
+	}
+
+	size := int64(len(buff))
+	if dc.maxBytes > 0 && size > dc.maxBytes {
+		return
+	}
+	folder := cache.GetBucketFolder(path)
+	dc.lock.Lock()
+	exceedsQuota := dc.exceedsQuota(folder, size)
+	bucketRevision := dc.bucketRevisions[folder]
+	dc.lock.Unlock()
+	if exceedsQuota {
+		return
+	}
+
+	item := &usageItem{
+		path:           path,
+		name:           getFileName(path),
+		size:           size,
+		expiresAt:      dc.limitExpiry(expiresAt, time.Now()),
+		bucketRevision: bucketRevision,
+	}
+	metaContent, err := encodeDiskMeta(item, data)
+	if err != nil {
+		dc.logger.WithFields(logrus.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Error("serializing-file-meta-failed")
+		return
+	}
+
+	// the meta file is written last, the content files without meta are ignored while loading
+	if err := writeFile(dc.filePath(item.name, contentExtension), buff); err != nil {
+		dc.logger.WithFields(logrus.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Error("writing-file-content-to-disk-failed")
+		return
+	}
+	if err := writeFile(dc.filePath(item.name, metaExtension), metaContent); err != nil {
+		dc.logger.WithFields(logrus.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Error("writing-file-meta-to-disk-failed")
+		os.Remove(dc.filePath(item.name, contentExtension))
+		return
+	}
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if dc.exceedsQuota(folder, size) {
+		// the quota is changed while the file is being written
+		os.Remove(dc.filePath(item.name, metaExtension))
+		os.Remove(dc.filePath(item.name, contentExtension))
+		return
+	}
+
+	dc.remove(path)
+
+	dc.logger.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("saved-file-into-disk-cache")
+
+	dc.usageElements[path] = dc.usage.PushFront(item)
+	dc.usedBytes += size
+	dc.folderBytes[folder] += size
+	dc.evictOverQuota(folder)
+	dc.evictLeastRecentlyUsed()
+}
+
+// limitExpiry returns the expiry of the file saved at the given time within the max age
+func (dc *FileDiskCache) limitExpiry(expiresAt, savedAt time.Time) time.Time {
+	if dc.maxAge <= 0 {
+		return expiresAt
+	}
+	if maxExpiresAt := savedAt.Add(dc.maxAge); expiresAt.IsZero() || expiresAt.After(maxExpiresAt) {
+		return maxExpiresAt
+	}
+	return expiresAt
+}
+
+// exceedsQuota returns true if the file is larger than the quota of its bucket folder. The lock must be held
+// by the caller.
+func (dc *FileDiskCache) exceedsQuota(folder string, size int64) bool {
+	quota := dc.quotas[folder]
+	return quota > 0 && size > quota
+}
+
+// GetFileVariant always returns false since the variants are kept only in the memory. They're cheap
+// to regenerate compared to fetching the files.
+func (dc *FileDiskCache) GetFileVariant(path string, meta *s3.GetObjectOutput, encoding string) ([]byte, bool) {
+	return nil, false
+}
+
+// SaveFileVariant ignores the variant, see GetFileVariant
+func (dc *FileDiskCache) SaveFileVariant(path string, meta *s3.GetObjectOutput, encoding string, buff []byte) {
+}
+
+// GetFileChunk always returns false since the chunks are kept only in the memory
+func (dc *FileDiskCache) GetFileChunk(path string, index int64) ([]byte, *s3.GetObjectOutput, bool) {
+	return nil, nil, false
+}
+
+// SaveFileChunk ignores the chunk, see GetFileChunk
+func (dc *FileDiskCache) SaveFileChunk(path string, index int64, meta *s3.GetObjectOutput, buff []byte) {
+}
+
+// SaveMissingFile removes the file from the disk. The missing files are not recorded on the disk
+// since they're short lived and kept by the memory cache.
+func (dc *FileDiskCache) SaveMissingFile(path string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.remove(path)
+}
+
+// IsFileMissing always returns false since the missing files are not recorded on the disk
+func (dc *FileDiskCache) IsFileMissing(path string) bool {
+	return false
+}
+
+// SaveLargeFile removes the file from the disk. The large files are not recorded on the disk like the
+// missing files.
+func (dc *FileDiskCache) SaveLargeFile(path string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.remove(path)
+}
+
+// IsFileTooLarge always returns false since the large files are not recorded on the disk
+func (dc *FileDiskCache) IsFileTooLarge(path string) bool {
+	return false
+}
+
+func (dc *FileDiskCache) SetQuotas(buckets []*model.Bucket) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.bucketRevisions = cache.GetBucketRevisions(buckets)
+	dc.quotas = cache.GetBucketQuotas(buckets)
+	for folder := range dc.quotas {
+		dc.evictOverQuota(folder)
+	}
+}
+
+func (dc *FileDiskCache) Purge(path string, isPrefix bool) cache.PurgeResult {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	result := cache.PurgeResult{}
+	for itemPath, element := range dc.usageElements {
+		if itemPath == path || (isPrefix && strings.HasPrefix(itemPath, path)) {
+			result.Entries++
+			result.Bytes += element.Value.(*usageItem).size
+			dc.remove(itemPath)
+		}
+	}
+	return result
+}
+
+// RemoveFilesOfChangedBuckets removes the files loaded from the disk that can't stay in the cache for the given
+// buckets. They belong to the removed buckets, the old versions or the buckets whose revisions are changed since
+// the files are saved.
+func (dc *FileDiskCache) RemoveFilesOfChangedBuckets(buckets []*model.Bucket) {
+	pathPrefixesToKeep := cache.GetPathPrefixesToKeep(buckets)
+	bucketRevisions := cache.GetBucketRevisions(buckets)
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	removed := cache.PurgeResult{}
+	for path, element := range dc.usageElements {
+		item := element.Value.(*usageItem)
+		if !cache.HasAnyPrefix(path, pathPrefixesToKeep) || item.bucketRevision != bucketRevisions[cache.GetBucketFolder(path)] {
+			removed.Entries++
+			removed.Bytes += item.size
+			dc.removeElement(element)
+		}
+	}
+
+	dc.logger.WithFields(logrus.Fields{
+		"removedEntries": removed.Entries,
+		"removedBytes":   removed.Bytes,
+	}).Info("removed-disk-cache-files-of-changed-buckets")
+}
+
+// load builds the usage list from the files in the cache directory. The files with the latest
+// modification time are considered the most recently used ones. Only the latest version of a file is loaded,
+// the older versions and the partially written files are left behind by a crash and they're removed.
+func (dc *FileDiskCache) load() error {
+	fileInfos, err := ioutil.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return fileInfos[i].ModTime().After(fileInfos[j].ModTime())
+	})
+
+	loadedNames := map[string]bool{}
+	for _, fileInfo := range fileInfos {
+		if !strings.HasSuffix(fileInfo.Name(), metaExtension) {
+			continue
+		}
+		name := strings.TrimSuffix(fileInfo.Name(), metaExtension)
+
+		meta, err := dc.readMeta(name)
+		if err != nil {
+			removeFiles(dc.filePath(name, metaExtension), dc.filePath(name, contentExtension))
+			continue
+		}
+
+		contentInfo, err := os.Stat(dc.filePath(name, contentExtension))
+		if err != nil {
+			removeFiles(dc.filePath(name, metaExtension), dc.filePath(name, contentExtension))
+			continue
+		}
+
+		if _, exists := dc.usageElements[meta.Path]; exists {
+			// a newer version of the file is already loaded
+			removeFiles(dc.filePath(name, metaExtension), dc.filePath(name, contentExtension))
+			continue
+		}
+		loadedNames[name] = true
+
+		dc.usageElements[meta.Path] = dc.usage.PushBack(&usageItem{
+			path:           meta.Path,
+			name:           name,
+			size:           contentInfo.Size(),
+			expiresAt:      dc.limitExpiry(meta.ExpiresAt, fileInfo.ModTime()),
+			bucketRevision: meta.BucketRevision,
+		})
+		dc.usedBytes += contentInfo.Size()
+		dc.folderBytes[cache.GetBucketFolder(meta.Path)] += contentInfo.Size()
+	}
+
+	// remove the temporary files and the content files whose meta files are not written or removed
+	for _, fileInfo := range fileInfos {
+		fileName := fileInfo.Name()
+		isOrphanContent := strings.HasSuffix(fileName, contentExtension) && !loadedNames[strings.TrimSuffix(fileName, contentExtension)]
+		if isOrphanContent || strings.HasSuffix(fileName, tmpExtension) {
+			removeFiles(filepath.Join(dc.dir, fileName))
+		}
+	}
+
+	dc.logger.WithFields(logrus.Fields{
+		"dir":       dc.dir,
+		"fileCount": dc.usage.Len(),
+		"usedBytes": dc.usedBytes,
+	}).Info("loaded-disk-cache")
+
+	dc.evictLeastRecentlyUsed()
+	return nil
+}
+
+// encodeDiskMeta returns the content of the metadata file of the item
+func encodeDiskMeta(item *usageItem, data *s3.GetObjectOutput) ([]byte, error) {
+	metaContent, err := cache.MarshalMeta(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(diskMeta{
+		Path:           item.path,
+		ExpiresAt:      item.expiresAt,
+		BucketRevision: item.bucketRevision,
+		Meta:           metaContent,
+	})
+}
+
+func (dc *FileDiskCache) readMeta(name string) (*diskMeta, error) {
+	content, err := ioutil.ReadFile(dc.filePath(name, metaExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta diskMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// evictLeastRecentlyUsed removes the least recently used files until the used bytes fit into the limit.
+// The lock must be held by the caller.
+func (dc *FileDiskCache) evictLeastRecentlyUsed() {
+	if dc.maxBytes <= 0 {
+		return
+	}
+
+	for dc.usedBytes > dc.maxBytes {
+		element := dc.usage.Back()
+		if element == nil {
+			return
+		}
+		dc.removeElement(element)
+	}
+}
+
+// evictOverQuota removes the least recently used files of the bucket folder until they fit into the bucket's
+// quota. The lock must be held by the caller.
+func (dc *FileDiskCache) evictOverQuota(folder string) {
+	quota := dc.quotas[folder]
+	if quota <= 0 {
+		return
+	}
+
+	// the usage list is shared by all the buckets, the files of the other buckets are skipped
+	element := dc.usage.Back()
+	for element != nil && dc.folderBytes[folder] > quota {
+		previous := element.Prev()
+		if item := element.Value.(*usageItem); cache.GetBucketFolder(item.path) == folder {
+			dc.removeElement(element)
+		}
+		element = previous
+	}
+}
+
+// remove deletes the file from the disk. The lock must be held by the caller.
+func (dc *FileDiskCache) remove(path string) {
+	if element, exists := dc.usageElements[path]; exists {
+		dc.removeElement(element)
+	}
+}
+
+// removeElement deletes the file of the usage list element from the disk. The lock must be held by the caller.
+func (dc *FileDiskCache) removeElement(element *list.Element) {
+	item := element.Value.(*usageItem)
+
+	dc.logger.WithFields(logrus.Fields{
+		"path": item.path,
+	}).Debug("removing-file-from-disk-cache")
+
+	removeFiles(dc.filePath(item.name, metaExtension), dc.filePath(item.name, contentExtension))
+
+	dc.usedBytes -= item.size
+	folder := cache.GetBucketFolder(item.path)
+	dc.folderBytes[folder] -= item.size
+	if dc.folderBytes[folder] <= 0 {
+		delete(dc.folderBytes, folder)
+	}
+	dc.usage.Remove(element)
+	if dc.usageElements[item.path] == element {
+		delete(dc.usageElements, item.path)
+	}
+}
+
+func (dc *FileDiskCache) filePath(name, extension string) string {
+	return filepath.Join(dc.dir, name+extension)
+}
+
+// getFileName returns a new file name that's safe to use on disk for the given file path. The name is unique
+// for each version of the file to replace the files without overwriting the ones that may be being read.
+func getFileName(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return hex.EncodeToString(hash[:]) + "-" + hex.EncodeToString(suffix)
+}
+
+// removeFiles removes the files ignoring the errors since they may be already removed
+func removeFiles(names ...string) {
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// writeFile writes the file into a temporary file first and renames it to prevent leaving
+// partially written files behind
+func writeFile(name string, content []byte) error {
+	tmpName := name + tmpExtension
+	if err := ioutil.WriteFile(tmpName, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
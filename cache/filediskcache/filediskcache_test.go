@@ -0,0 +1,200 @@
+package filediskcache
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadsFilesSavedBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	cache, err := New(ctx, dir, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/b.js", &s3.GetObjectOutput{ContentType: aws.String("text/javascript")}, []byte("bbbb"))
+	cache.SaveFile("a1b2c3/0.0.1/c.js", &s3.GetObjectOutput{}, []byte("cccc"))
+
+	// create another cache from the same directory like the server is restarted
+	reloadedCache, err := New(ctx, dir, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, hasA := reloadedCache.GetFile("a1b2c3/0.0.1/a.js")
+	assert.False(t, hasA, "evicted file must not be loaded")
+
+	buff, meta, hasB := reloadedCache.GetFile("a1b2c3/0.0.1/b.js")
+	assert.True(t, hasB, "file must be loaded from the disk")
+	assert.Equal(t, []byte("bbbb"), buff, "incorrect file content")
+	assert.Equal(t, "text/javascript", aws.StringValue(meta.ContentType), "file meta must be loaded from the disk")
+	assert.Equal(t, int64(8), reloadedCache.usedBytes, "incorrect used bytes")
+}
+
+func TestEvictsFilesOfBucketOverQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := New(log.WithLogger(context.Background(), logrus.New()), dir, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetQuotas([]*model.Bucket{{Folder: aws.String("a1b2c3"), CacheMaxBytes: aws.Int64(8)}})
+
+	cache.SaveFile("d4e5f6/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/b.js", &s3.GetObjectOutput{}, []byte("bbbb"))
+	cache.SaveFile("a1b2c3/0.0.1/c.js", &s3.GetObjectOutput{}, []byte("cccc"))
+
+	_, _, hasOtherBucket := cache.GetFile("d4e5f6/0.0.1/a.js")
+	_, _, hasA := cache.GetFile("a1b2c3/0.0.1/a.js")
+	assert.True(t, hasOtherBucket, "file of the other bucket must be kept")
+	assert.False(t, hasA, "least recently used file of the bucket must be evicted")
+	assert.Equal(t, int64(8), cache.folderBytes["a1b2c3"], "incorrect used bytes of the bucket")
+}
+
+func TestLoadsLatestVersionLeftByCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// both versions of the file are left on the disk like the process is stopped while replacing the file
+	writeVersion := func(content string, modTime time.Time) string {
+		name := getFileName("a1b2c3/0.0.1/a.js")
+		metaContent, err := encodeDiskMeta(&usageItem{path: "a1b2c3/0.0.1/a.js"}, &s3.GetObjectOutput{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for extension, fileContent := range map[string][]byte{contentExtension: []byte(content), metaExtension: metaContent} {
+			filePath := filepath.Join(dir, name+extension)
+			if err := ioutil.WriteFile(filePath, fileContent, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return name
+	}
+	oldName := writeVersion("old", time.Now().Add(-time.Hour))
+	writeVersion("new", time.Now())
+	ioutil.WriteFile(filepath.Join(dir, "leftover.content"), []byte("leftover"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "leftover.meta.tmp"), []byte("{}"), 0644)
+
+	cache, err := New(log.WithLogger(context.Background(), logrus.New()), dir, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buff, _, hasCache := cache.GetFile("a1b2c3/0.0.1/a.js")
+	assert.True(t, hasCache, "file must be loaded from the disk")
+	assert.Equal(t, []byte("new"), buff, "latest version must be loaded")
+	assert.Equal(t, int64(3), cache.usedBytes, "file must be counted once")
+	assert.Equal(t, 1, cache.usage.Len(), "file must be listed once")
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, fileInfos, 2, "only the meta and the content of the latest version must be kept")
+	_, err = os.Stat(filepath.Join(dir, oldName+metaExtension))
+	assert.True(t, os.IsNotExist(err), "old version must be removed")
+
+	// evicting must not get stuck on the files loaded from the disk
+	cache.SaveFile("a1b2c3/0.0.1/b.js", &s3.GetObjectOutput{}, []byte("bbbb"))
+	_, _, hasA := cache.GetFile("a1b2c3/0.0.1/a.js")
+	assert.False(t, hasA, "least recently used file must be evicted")
+	assert.Equal(t, int64(4), cache.usedBytes, "incorrect used bytes")
+}
+
+func TestRevalidatesFilesAfterMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := New(log.WithLogger(context.Background(), logrus.New()), dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/b.js", &s3.GetObjectOutput{CacheControl: aws.String("max-age=60")}, []byte("bbbb"))
+	cache.SaveFileWithExpiry("a1b2c3/0.0.1/c.js", &s3.GetObjectOutput{}, []byte("cccc"), time.Now().Add(-time.Minute))
+
+	_, _, expiresAt, hasA := cache.GetFileWithExpiry("a1b2c3/0.0.1/a.js")
+	assert.True(t, hasA, "file must be found")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute, "file without expiry must expire after the max age")
+
+	_, _, expiresAt, _ = cache.GetFileWithExpiry("a1b2c3/0.0.1/b.js")
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, time.Minute, "shorter expiry must be kept")
+
+	_, _, hasC := cache.GetFile("a1b2c3/0.0.1/c.js")
+	assert.False(t, hasC, "expired file must not be served")
+}
+
+func TestRemovesFilesOfBucketsChangedWhileDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newBucket := func(folder string, revision int) *model.Bucket {
+		return &model.Bucket{
+			Folder:         aws.String(folder),
+			Version:        aws.String("0.0.1"),
+			Status:         aws.String("active"),
+			IsCacheEnabled: aws.Bool(true),
+			Revision:       revision,
+		}
+	}
+
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	cache, err := New(ctx, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetQuotas([]*model.Bucket{newBucket("a1b2c3", 1), newBucket("d4e5f6", 1), newBucket("g7h8i9", 1)})
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("d4e5f6/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("g7h8i9/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+
+	// the second bucket is uploaded again and the third one is removed while the server is down
+	reloadedCache, err := New(ctx, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedCache.RemoveFilesOfChangedBuckets([]*model.Bucket{newBucket("a1b2c3", 1), newBucket("d4e5f6", 2)})
+
+	_, _, hasUnchanged := reloadedCache.GetFile("a1b2c3/0.0.1/a.js")
+	_, _, hasChanged := reloadedCache.GetFile("d4e5f6/0.0.1/a.js")
+	_, _, hasRemoved := reloadedCache.GetFile("g7h8i9/0.0.1/a.js")
+	assert.True(t, hasUnchanged, "file of the unchanged bucket must be kept")
+	assert.False(t, hasChanged, "file of the changed bucket must be removed")
+	assert.False(t, hasRemoved, "file of the removed bucket must be removed")
+	assert.Equal(t, int64(4), reloadedCache.usedBytes, "incorrect used bytes")
+}
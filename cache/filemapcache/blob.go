@@ -0,0 +1,80 @@
+package filemapcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// blob is a content shared by the entries that have the same content like the same file in different versions
+// of a bucket. The content is kept once no matter how many entries use it.
+type blob struct {
+	content []byte
+
+	// refs is the number of the entries that use the blob by their bucket folders
+	refs map[string]int
+}
+
+// getBlobKey returns the key of the entry's content. The files with the same ETag and size are considered to have
+// the same content, the content is hashed if the ETag is not known.
+func getBlobKey(e *entry) string {
+	if e.meta == nil || e.meta.ETag == nil || *e.meta.ETag == "" {
+		hash := sha256.Sum256(e.content)
+		return "sha256:" + hex.EncodeToString(hash[:])
+	}
+
+	key := "etag:" + *e.meta.ETag + ":" + strconv.Itoa(len(e.content))
+	if e.isChunk {
+		// the chunks of the same file have the same ETag
+		key += ":" + strconv.FormatInt(e.chunkIndex, 10)
+	}
+	return key
+}
+
+// retainBlob makes the entry use the blob of its content and returns the bytes added to the generation and to the
+// entry's folder. The content is counted only for the first entry that uses it. The lock must be held by the caller.
+func (g *generation) retainBlob(e *entry) (int64, int64) {
+	contentBytes := int64(len(e.content))
+	if e.blobKey == "" {
+		return contentBytes, contentBytes
+	}
+
+	var addedBytes, addedFolderBytes int64
+	b, exists := g.blobs[e.blobKey]
+	if exists {
+		// the content of the entry is dropped to keep a single copy
+		e.content = b.content
+	} else {
+		b = &blob{content: e.content, refs: map[string]int{}}
+		g.blobs[e.blobKey] = b
+		addedBytes = contentBytes
+	}
+
+	if b.refs[e.folder] == 0 {
+		addedFolderBytes = contentBytes
+	}
+	b.refs[e.folder]++
+	return addedBytes, addedFolderBytes
+}
+
+// releaseBlob is the reverse of retainBlob. It returns the bytes removed from the generation and from the entry's
+// folder. The blob is removed when it's not used by any entry. The lock must be held by the caller.
+func (g *generation) releaseBlob(e *entry) (int64, int64) {
+	contentBytes := int64(len(e.content))
+	if e.blobKey == "" {
+		return contentBytes, contentBytes
+	}
+
+	var removedBytes, removedFolderBytes int64
+	b := g.blobs[e.blobKey]
+	b.refs[e.folder]--
+	if b.refs[e.folder] == 0 {
+		delete(b.refs, e.folder)
+		removedFolderBytes = contentBytes
+	}
+	if len(b.refs) == 0 {
+		delete(g.blobs, e.blobKey)
+		removedBytes = contentBytes
+	}
+	return removedBytes, removedFolderBytes
+}
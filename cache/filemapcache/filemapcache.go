@@ -3,39 +3,65 @@ package filemapcache
 import (
 	"context"
 	"github.com/aws/aws-sdk-go/service/s3"
-	core "github.com/devingen/api-core"
 	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/config"
 	"github.com/devingen/sepet-cdn/model"
 	"github.com/sirupsen/logrus"
-	"strings"
-	"sync"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
-// resetTicker controls the frequency of underlying cache resetting.
-var resetTicker *time.Ticker
-
-// FileMapCache implements IFileCache interface with map cache storage
+// FileMapCache implements IFileCache interface with map cache storage. The content and the meta of a file
+// are kept together in a single entry. The entries belong to a generation and resetting the cache swaps the
+// current generation with an empty one atomically.
 type FileMapCache struct {
-	logger       *logrus.Logger
-	contentCache sync.Map
-	metaCache    sync.Map
+	// hits, misses and evictions are the counters for the statistics. They're updated atomically and
+	// kept at the beginning of the struct to be 64-bit aligned.
+	hits      int64
+	misses    int64
+	evictions int64
+
+	logger *logrus.Logger
+
+	// current holds the *generation that keeps the entries
+	current atomic.Value
+
+	// quotas holds the map[string]int64 of the cache size limits of the buckets by their folders
+	quotas atomic.Value
+
+	// maxBytes is the total content size limit of the cache. Zero means unlimited.
+	maxBytes int64
+
+	// maxObjectBytes is the content size limit of a single file. Zero means unlimited.
+	maxObjectBytes int64
+
+	// notFoundTTL is how long the files that are not found are remembered. Zero disables it.
+	notFoundTTL time.Duration
+
+	// largeFileTTL is how long the files that are too large to cache are remembered. Zero disables it.
+	largeFileTTL time.Duration
 }
 
-func New(ctx context.Context, cacheResetInterval time.Duration) (*FileMapCache, error) {
+func New(ctx context.Context, cacheConfig config.Cache) (*FileMapCache, error) {
 	logger, err := log.Of(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	cache := &FileMapCache{
-		logger:       logger,
-		contentCache: sync.Map{},
-		metaCache:    sync.Map{},
+		logger:         logger,
+		maxBytes:       cacheConfig.MaxBytes,
+		maxObjectBytes: cacheConfig.MaxObjectBytes,
+		notFoundTTL:    cacheConfig.NotFoundTTL,
+		largeFileTTL:   cacheConfig.LargeFileTTL,
 	}
+	cache.current.Store(newGeneration())
+	cache.quotas.Store(map[string]int64{})
 
-	// update the data periodically
-	resetTicker = time.NewTicker(cacheResetInterval)
+	// reset the data periodically to drop the entries that are never requested again
+	resetTicker := time.NewTicker(cacheConfig.ResetInterval)
 	go func() {
 		for range resetTicker.C {
 			cache.Reset()
@@ -46,73 +72,470 @@ func New(ctx context.Context, cacheResetInterval time.Duration) (*FileMapCache,
 }
 
 func (mc *FileMapCache) GetFile(path string) ([]byte, *s3.GetObjectOutput, bool) {
-	meta, hasMeta := mc.metaCache.Load(path)
-	buff, hasBuff := mc.contentCache.Load(path)
+	buff, meta, _, hasCache := mc.GetFileWithExpiry(path)
+	return buff, meta, hasCache
+}
+
+// GetFileWithExpiry implements IExpiringFileCache interface
+func (mc *FileMapCache) GetFileWithExpiry(path string) ([]byte, *s3.GetObjectOutput, time.Time, bool) {
+	e, staleness, hasCache := mc.getFile(path)
+	if !hasCache || staleness > 0 {
+		atomic.AddInt64(&mc.misses, 1)
+		return nil, nil, time.Time{}, false
+	}
+	atomic.AddInt64(&mc.hits, 1)
+	return e.content, e.meta, e.expiresAt, true
+}
+
+// GetStaleFile returns the file even if it's expired. The expired files are kept in the cache
+// to be revalidated or to be served while the file service is failing.
+func (mc *FileMapCache) GetStaleFile(path string) ([]byte, *s3.GetObjectOutput, time.Duration, bool) {
+	e, staleness, hasCache := mc.getFile(path)
+	if !hasCache {
+		return nil, nil, 0, false
+	}
+	return e.content, e.meta, staleness, true
+}
+
+func (mc *FileMapCache) getFile(path string) (*entry, time.Duration, bool) {
+	g := mc.generation()
+	g.lock.Lock()
+	e, exists := g.get(path)
+	g.lock.Unlock()
+
+	exists = exists && !e.isRecord()
+
+	var staleness time.Duration
+	if exists {
+		staleness = cache.GetStaleness(e.expiresAt, time.Now())
+	}
 
 	mc.logger.WithFields(logrus.Fields{
-		"exists": hasBuff && hasMeta,
-		"path":   path,
+		"exists":    exists,
+		"staleness": staleness,
+		"path":      path,
 	}).Debug("getting-file-from-cache")
 
-	if hasMeta && hasBuff {
-		return buff.([]byte), meta.(*s3.GetObjectOutput), true
+	if exists {
+		return e, staleness, true
 	}
-	return nil, nil, false
+	return nil, 0, false
 }
 
 func (mc *FileMapCache) SaveFile(path string, data *s3.GetObjectOutput, buff []byte) {
+	mc.SaveFileWithExpiry(path, data, buff, cache.GetExpiry(data, time.Now()))
+}
+
+// SaveFileWithExpiry implements IExpiringFileCache interface
+func (mc *FileMapCache) SaveFileWithExpiry(path string, data *s3.GetObjectOutput, buff []byte, expiresAt time.Time) {
+	if !cache.IsStorable(data) {
+		mc.logger.WithFields(logrus.Fields{
+			"path": path,
+		}).Debug("skipping-unstorable-file-for-cache")
+
+		// the previous version of the file must not be served anymore
+		g := mc.generation()
+		g.lock.Lock()
+		g.remove(path)
+		g.lock.Unlock()
+		return
+	}
+
+	size := int64(len(buff))
+	if mc.isTooLarge(path, size) {
+		mc.logger.WithFields(logrus.Fields{
+			"path": path,
+			"size": size,
+		}).Debug("skipping-large-file-for-cache")
+		return
+	}
+
 	mc.logger.WithFields(logrus.Fields{
 		"path": path,
 	}).Debug("saving-file-into-cache")
 
-	mc.contentCache.Store(path, buff)
-	mc.metaCache.Store(path, data)
+	mc.add(&entry{
+		path:      path,
+		content:   buff,
+		meta:      data,
+		size:      size,
+		savedAt:   time.Now(),
+		expiresAt: expiresAt,
+	})
+}
+
+func (mc *FileMapCache) GetFileVariant(path string, meta *s3.GetObjectOutput, encoding string) ([]byte, bool) {
+	g := mc.generation()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	e, exists := g.peek(path)
+	if !exists || e.meta != meta {
+		return nil, false
+	}
+
+	buff, hasVariant := e.variants[encoding]
+	return buff, hasVariant
+}
+
+func (mc *FileMapCache) SaveFileVariant(path string, meta *s3.GetObjectOutput, encoding string, buff []byte) {
+	g := mc.generation()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	e, exists := g.peek(path)
+	if !exists || e.meta != meta {
+		return
+	}
+
+	mc.logger.WithFields(logrus.Fields{
+		"path":     path,
+		"encoding": encoding,
+	}).Debug("saving-file-variant-into-cache")
+
+	g.setVariant(e, encoding, buff)
+	mc.evictOverQuota(g, e.folder)
+	mc.evictLeastRecentlyUsed(g)
+}
+
+// GetFileChunk returns the chunk of the file if it's cached and not expired
+func (mc *FileMapCache) GetFileChunk(path string, index int64) ([]byte, *s3.GetObjectOutput, bool) {
+	g := mc.generation()
+	g.lock.Lock()
+	e, exists := g.getChunk(chunkKey{path: path, index: index})
+	g.lock.Unlock()
+
+	if !exists || cache.GetStaleness(e.expiresAt, time.Now()) > 0 {
+		atomic.AddInt64(&mc.misses, 1)
+		return nil, nil, false
+	}
+	atomic.AddInt64(&mc.hits, 1)
+	return e.content, e.meta, true
+}
+
+func (mc *FileMapCache) SaveFileChunk(path string, index int64, meta *s3.GetObjectOutput, buff []byte) {
+	if !cache.IsStorable(meta) {
+		return
+	}
+
+	size := int64(len(buff))
+	if mc.isTooLarge(path, size) {
+		mc.logger.WithFields(logrus.Fields{
+			"path":  path,
+			"chunk": index,
+			"size":  size,
+		}).Debug("skipping-large-file-chunk-for-cache")
+		return
+	}
+
+	mc.logger.WithFields(logrus.Fields{
+		"path":  path,
+		"chunk": index,
+	}).Debug("saving-file-chunk-into-cache")
+
+	now := time.Now()
+	mc.add(&entry{
+		path:       path,
+		content:    buff,
+		meta:       meta,
+		isChunk:    true,
+		chunkIndex: index,
+		size:       size,
+		savedAt:    now,
+		expiresAt:  cache.GetExpiry(meta, now),
+	})
+}
+
+// SaveMissingFile records that the file is not found for the not found TTL. The cached file
+// with the same path is removed.
+func (mc *FileMapCache) SaveMissingFile(path string) {
+	if mc.notFoundTTL <= 0 {
+		g := mc.generation()
+		g.lock.Lock()
+		g.remove(path)
+		g.lock.Unlock()
+		return
+	}
+
+	mc.logger.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("saving-missing-file-into-cache")
+
+	// the path is the only data kept for the missing files
+	now := time.Now()
+	mc.add(&entry{
+		path:      path,
+		size:      int64(len(path)),
+		savedAt:   now,
+		expiresAt: now.Add(mc.notFoundTTL),
+		isMissing: true,
+	})
+}
+
+// IsFileMissing returns true if the file is recorded as not found and the record is not expired
+func (mc *FileMapCache) IsFileMissing(path string) bool {
+	return mc.hasRecord(path, func(e *entry) bool {
+		return e.isMissing
+	})
+}
+
+// SaveLargeFile records that the file is too large to be cached for the large file TTL. The cached file
+// with the same path is removed.
+func (mc *FileMapCache) SaveLargeFile(path string) {
+	if mc.largeFileTTL <= 0 {
+		g := mc.generation()
+		g.lock.Lock()
+		g.remove(path)
+		g.lock.Unlock()
+		return
+	}
+
+	mc.logger.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("saving-large-file-into-cache")
+
+	// the path is the only data kept for the large files
+	now := time.Now()
+	mc.add(&entry{
+		path:       path,
+		size:       int64(len(path)),
+		savedAt:    now,
+		expiresAt:  now.Add(mc.largeFileTTL),
+		isTooLarge: true,
+	})
+}
+
+// IsFileTooLarge returns true if the file is recorded as too large to be cached and the record is not expired
+func (mc *FileMapCache) IsFileTooLarge(path string) bool {
+	return mc.hasRecord(path, func(e *entry) bool {
+		return e.isTooLarge
+	})
+}
+
+// hasRecord returns true if the file has a record entry that matches and the record is not expired.
+// The expired record is removed.
+func (mc *FileMapCache) hasRecord(path string, matches func(e *entry) bool) bool {
+	g := mc.generation()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	e, exists := g.get(path)
+	if !exists || !matches(e) {
+		return false
+	}
+
+	if !time.Now().Before(e.expiresAt) {
+		g.remove(path)
+		return false
+	}
+	return true
 }
 
+// Reset removes all the entries by replacing the current generation with an empty one
 func (mc *FileMapCache) Reset() {
 	mc.logger.Info("resetting-cache")
-	mc.contentCache = sync.Map{}
-	mc.metaCache = sync.Map{}
+	mc.current.Store(newGeneration())
 }
 
-func (mc *FileMapCache) Invalidate(buckets []*model.Bucket) {
-	mc.logger.Info("invalidating-cache")
+func (mc *FileMapCache) SetQuotas(buckets []*model.Bucket) {
+	quotas := cache.GetBucketQuotas(buckets)
+	mc.quotas.Store(quotas)
+
+	g := mc.generation()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for folder := range quotas {
+		mc.evictOverQuota(g, folder)
+	}
+}
 
-	pathPrefixesToKeep := map[string]bool{}
-	for _, bucket := range buckets {
-		if core.StringValue(bucket.Status) != "active" || !core.BoolValue(bucket.IsCacheEnabled) {
-			// skip the bucket if the status is not active or caching is not enabled
-			continue
+func (mc *FileMapCache) Purge(path string, isPrefix bool) cache.PurgeResult {
+	g := mc.generation()
+	g.lock.Lock()
+	result := cache.PurgeResult{}
+	usedBytes := g.usedBytes
+	for _, e := range g.find(path, isPrefix) {
+		result.Entries++
+		g.removeEntry(e)
+	}
+	// the shared contents are freed only when their last entry is removed
+	result.Bytes = usedBytes - g.usedBytes
+	g.lock.Unlock()
+
+	mc.logger.WithFields(logrus.Fields{
+		"path":     path,
+		"isPrefix": isPrefix,
+		"entries":  result.Entries,
+		"bytes":    result.Bytes,
+	}).Info("purged-cache")
+
+	return result
+}
+
+// Stats implements IFileCacheInspector interface
+func (mc *FileMapCache) Stats() cache.Stats {
+	g := mc.generation()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	quotas := mc.getQuotas()
+	stats := cache.Stats{
+		Entries:   len(g.entries) + len(g.chunks),
+		Bytes:     g.usedBytes,
+		MaxBytes:  mc.maxBytes,
+		Hits:      atomic.LoadInt64(&mc.hits),
+		Misses:    atomic.LoadInt64(&mc.misses),
+		Evictions: atomic.LoadInt64(&mc.evictions),
+		Buckets:   map[string]*cache.BucketStats{},
+	}
+
+	for _, e := range g.all() {
+		age := int64(now.Sub(e.savedAt) / time.Second)
+
+		folder := cache.GetBucketFolder(e.path)
+		bucketStats, exists := stats.Buckets[folder]
+		if !exists {
+			bucketStats = &cache.BucketStats{Bytes: g.folderBytes(folder), MaxBytes: quotas[folder]}
+			stats.Buckets[folder] = bucketStats
 		}
+		bucketStats.Entries++
 
-		if core.StringValue(bucket.VersionIdentifier) == "path" {
-			// if the version identifier is path, files from different versions may have been cached.
-			// we need to keep the files from all the versions of the bucket.
-			// so keep all the paths starting for the bucket.
-			prefix := core.StringValue(bucket.Folder) + "/"
-			pathPrefixesToKeep[prefix] = true
-			continue
+		if age > bucketStats.OldestEntryAge {
+			bucketStats.OldestEntryAge = age
+		}
+		if age > stats.OldestEntryAge {
+			stats.OldestEntryAge = age
 		}
+	}
+	return stats
+}
 
-		// keep the files of the active version of the bucket
-		// this will remove the cache for older version if the version is changed
-		prefix := core.StringValue(bucket.Folder) + "/" + core.StringValue(bucket.Version)
-		pathPrefixesToKeep[prefix] = true
+// Entries implements IFileCacheInspector interface
+func (mc *FileMapCache) Entries(prefix string) []cache.EntryInfo {
+	g := mc.generation()
+	g.lock.Lock()
+	found := g.find(prefix, true)
+	entries := make([]cache.EntryInfo, len(found))
+	for i, e := range found {
+		entries[i] = cache.EntryInfo{
+			Path:       e.path,
+			Bytes:      e.size,
+			SavedAt:    e.savedAt,
+			IsMissing:  e.isMissing,
+			IsTooLarge: e.isTooLarge,
+		}
+		if e.isChunk {
+			chunkIndex := e.chunkIndex
+			entries[i].ChunkIndex = &chunkIndex
+		}
+		if !e.expiresAt.IsZero() {
+			expiresAt := e.expiresAt
+			entries[i].ExpiresAt = &expiresAt
+		}
 	}
+	g.lock.Unlock()
 
-	mc.metaCache.Range(func(key, value interface{}) bool {
-		for prefix := range pathPrefixesToKeep {
-			if strings.Index(key.(string), prefix) == 0 {
-				// keep the file
-				return true
-			}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Path == entries[j].Path {
+			// the whole file comes before the chunks
+			return entries[i].ChunkIndex == nil || (entries[j].ChunkIndex != nil && *entries[i].ChunkIndex < *entries[j].ChunkIndex)
 		}
-		mc.logger.WithFields(logrus.Fields{
-			"path": key,
-		}).Debug("removing-file-from-cache")
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
 
-		mc.metaCache.Delete(key)
-		mc.contentCache.Delete(key)
+// generation returns the current generation
+func (mc *FileMapCache) generation() *generation {
+	return mc.current.Load().(*generation)
+}
+
+// getQuotas returns the cache size limits of the buckets by their folders
+func (mc *FileMapCache) getQuotas() map[string]int64 {
+	return mc.quotas.Load().(map[string]int64)
+}
+
+// isTooLarge returns true if the content doesn't fit into the cache, a single file or the bucket's quota
+func (mc *FileMapCache) isTooLarge(path string, size int64) bool {
+	if (mc.maxObjectBytes > 0 && size > mc.maxObjectBytes) || (mc.maxBytes > 0 && size > mc.maxBytes) {
 		return true
-	})
+	}
+	quota := mc.getQuotas()[cache.GetBucketFolder(path)]
+	return quota > 0 && size > quota
+}
+
+// add puts the entry into the current generation and evicts the least recently used entries
+// if the size limit is exceeded. The variants of the replaced entry are kept if the content is the same
+// and the content is shared with the other entries that have the same content.
+func (mc *FileMapCache) add(e *entry) {
+	if len(e.content) > 0 {
+		// the key is generated before locking the generation since the content may be hashed
+		e.blobKey = getBlobKey(e)
+	}
+
+	g := mc.generation()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if previous, exists := g.peek(e.path); exists && !e.isChunk && !previous.isRecord() && !e.isRecord() && hasSameContent(previous, e) {
+		// the entry isn't in the generation yet, its size is added to the used bytes by g.add
+		e.variants = previous.variants
+		for _, buff := range previous.variants {
+			e.size += int64(len(buff))
+		}
+	}
+
+	g.add(e)
+	mc.evictOverQuota(g, e.folder)
+	mc.evictLeastRecentlyUsed(g)
+}
+
+// evictOverQuota removes the least recently used entries of the bucket folder until they fit into the bucket's
+// quota. The entries of the other buckets are not affected. The lock of the generation must be held by the caller.
+func (mc *FileMapCache) evictOverQuota(g *generation, folder string) {
+	quota := mc.getQuotas()[folder]
+	if quota <= 0 {
+		return
+	}
+
+	for g.folderBytes(folder) > quota {
+		leastRecentlyUsed, exists := g.leastRecentlyUsedInFolder(folder)
+		if !exists {
+			return
+		}
+
+		mc.logger.WithFields(logrus.Fields{
+			"path":  leastRecentlyUsed.path,
+			"size":  leastRecentlyUsed.size,
+			"quota": quota,
+		}).Debug("evicting-file-over-bucket-quota")
+
+		g.removeEntry(leastRecentlyUsed)
+		atomic.AddInt64(&mc.evictions, 1)
+	}
+}
+
+// evictLeastRecentlyUsed removes the least recently used entries until the used bytes fit into the limit.
+// The lock of the generation must be held by the caller.
+func (mc *FileMapCache) evictLeastRecentlyUsed(g *generation) {
+	if mc.maxBytes <= 0 {
+		return
+	}
+
+	for g.usedBytes > mc.maxBytes {
+		leastRecentlyUsed, exists := g.leastRecentlyUsed()
+		if !exists {
+			return
+		}
+
+		mc.logger.WithFields(logrus.Fields{
+			"path": leastRecentlyUsed.path,
+			"size": leastRecentlyUsed.size,
+		}).Debug("evicting-file-from-cache")
+
+		g.removeEntry(leastRecentlyUsed)
+		atomic.AddInt64(&mc.evictions, 1)
+	}
 }
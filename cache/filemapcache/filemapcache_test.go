@@ -0,0 +1,327 @@
+package filemapcache
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, cacheConfig config.Cache) *FileMapCache {
+	if cacheConfig.ResetInterval == 0 {
+		cacheConfig.ResetInterval = time.Hour
+	}
+	cache, err := New(log.WithLogger(context.Background(), logrus.New()), cacheConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestEvictsLeastRecentlyUsedFiles(t *testing.T) {
+	cache := newTestCache(t, config.Cache{MaxBytes: 10})
+
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/b.js", &s3.GetObjectOutput{}, []byte("bbbb"))
+
+	// use 'a.js' so that 'b.js' becomes the least recently used file
+	_, _, hasA := cache.GetFile("a1b2c3/0.0.1/a.js")
+	assert.True(t, hasA, "file must be cached")
+
+	cache.SaveFile("a1b2c3/0.0.1/c.js", &s3.GetObjectOutput{}, []byte("cccc"))
+
+	_, _, hasA = cache.GetFile("a1b2c3/0.0.1/a.js")
+	_, _, hasB := cache.GetFile("a1b2c3/0.0.1/b.js")
+	_, _, hasC := cache.GetFile("a1b2c3/0.0.1/c.js")
+	assert.True(t, hasA, "recently used file must be kept")
+	assert.False(t, hasB, "least recently used file must be evicted")
+	assert.True(t, hasC, "saved file must be cached")
+	assert.Equal(t, int64(8), cache.Stats().Bytes, "incorrect used bytes")
+}
+
+func TestSkipsFilesLargerThanObjectLimit(t *testing.T) {
+	cache := newTestCache(t, config.Cache{MaxBytes: 100, MaxObjectBytes: 4})
+
+	cache.SaveFile("a1b2c3/0.0.1/small.js", &s3.GetObjectOutput{}, []byte("abcd"))
+	cache.SaveFile("a1b2c3/0.0.1/large.mp4", &s3.GetObjectOutput{}, []byte("abcde"))
+
+	_, _, hasSmall := cache.GetFile("a1b2c3/0.0.1/small.js")
+	_, _, hasLarge := cache.GetFile("a1b2c3/0.0.1/large.mp4")
+	assert.True(t, hasSmall, "small file must be cached")
+	assert.False(t, hasLarge, "large file must not be cached")
+}
+
+func TestSkipsFilesThatMustNotBeStored(t *testing.T) {
+	cache := newTestCache(t, config.Cache{StaleIfError: time.Hour})
+
+	cache.SaveFile("a1b2c3/0.0.1/user.json", &s3.GetObjectOutput{}, []byte("public"))
+	cache.SaveFile("a1b2c3/0.0.1/user.json", &s3.GetObjectOutput{CacheControl: aws.String("private")}, []byte("private"))
+	cache.SaveFile("a1b2c3/0.0.1/token.json", &s3.GetObjectOutput{CacheControl: aws.String("no-store")}, []byte("token"))
+
+	_, _, _, hasPrivate := cache.GetStaleFile("a1b2c3/0.0.1/user.json")
+	_, _, _, hasNoStore := cache.GetStaleFile("a1b2c3/0.0.1/token.json")
+	assert.False(t, hasPrivate, "private file must not be cached and its previous version must be removed")
+	assert.False(t, hasNoStore, "no-store file must not be cached")
+}
+
+func TestKeepsExpiredFilesAsStale(t *testing.T) {
+	cache := newTestCache(t, config.Cache{})
+
+	cache.SaveFile("a1b2c3/0.0.1/index.html", &s3.GetObjectOutput{CacheControl: aws.String("no-cache")}, []byte("index"))
+	cache.SaveFile("a1b2c3/0.0.1/main.1a2b.js", &s3.GetObjectOutput{CacheControl: aws.String("max-age=86400")}, []byte("main"))
+
+	_, _, hasIndex := cache.GetFile("a1b2c3/0.0.1/index.html")
+	_, _, hasMain := cache.GetFile("a1b2c3/0.0.1/main.1a2b.js")
+	assert.False(t, hasIndex, "expired file must not be returned")
+	assert.True(t, hasMain, "fresh file must be returned")
+
+	_, _, staleness, hasStaleIndex := cache.GetStaleFile("a1b2c3/0.0.1/index.html")
+	assert.True(t, hasStaleIndex, "expired file must be returned as stale")
+	assert.True(t, staleness > 0, "expired file must have staleness")
+
+	_, _, staleness, hasStaleMain := cache.GetStaleFile("a1b2c3/0.0.1/main.1a2b.js")
+	assert.True(t, hasStaleMain, "fresh file must be returned as stale")
+	assert.Equal(t, time.Duration(0), staleness, "fresh file must not have staleness")
+}
+
+func TestRemembersMissingFilesUntilPurged(t *testing.T) {
+	cache := newTestCache(t, config.Cache{NotFoundTTL: time.Minute})
+
+	cache.SaveFile("a1b2c3/0.0.1/old.js", &s3.GetObjectOutput{}, []byte("old"))
+	cache.SaveMissingFile("a1b2c3/0.0.1/old.js")
+	cache.SaveMissingFile("a1b2c3/0.0.1/wp-admin")
+
+	_, _, hasOld := cache.GetFile("a1b2c3/0.0.1/old.js")
+	assert.False(t, hasOld, "missing file must replace the cached file")
+	assert.True(t, cache.IsFileMissing("a1b2c3/0.0.1/wp-admin"), "missing file must be remembered")
+	assert.False(t, cache.IsFileMissing("a1b2c3/0.0.1/index.html"), "unknown file must not be missing")
+
+	cache.Purge("a1b2c3/", true)
+	assert.False(t, cache.IsFileMissing("a1b2c3/0.0.1/wp-admin"), "missing file must be purged")
+	assert.Equal(t, int64(0), cache.Stats().Bytes, "incorrect used bytes")
+}
+
+func TestEvictsFilesOfBucketOverQuota(t *testing.T) {
+	cache := newTestCache(t, config.Cache{MaxBytes: 100})
+	cache.SetQuotas([]*model.Bucket{{Folder: aws.String("a1b2c3"), CacheMaxBytes: aws.Int64(8)}})
+
+	cache.SaveFile("d4e5f6/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.1/b.js", &s3.GetObjectOutput{}, []byte("bbbb"))
+
+	// use 'a.js' so that 'b.js' becomes the least recently used file of the bucket
+	cache.GetFile("a1b2c3/0.0.1/a.js")
+	cache.SaveFile("a1b2c3/0.0.1/c.js", &s3.GetObjectOutput{}, []byte("cccc"))
+	cache.SaveFile("a1b2c3/0.0.1/large.mp4", &s3.GetObjectOutput{}, []byte("abcdefghi"))
+
+	_, _, hasOtherBucket := cache.GetFile("d4e5f6/0.0.1/a.js")
+	_, _, hasA := cache.GetFile("a1b2c3/0.0.1/a.js")
+	_, _, hasB := cache.GetFile("a1b2c3/0.0.1/b.js")
+	_, _, hasLarge := cache.GetFile("a1b2c3/0.0.1/large.mp4")
+	assert.True(t, hasOtherBucket, "file of the other bucket must be kept although it's used less recently")
+	assert.True(t, hasA, "recently used file of the bucket must be kept")
+	assert.False(t, hasB, "least recently used file of the bucket must be evicted")
+	assert.False(t, hasLarge, "file larger than the quota must not be cached")
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(8), stats.Buckets["a1b2c3"].Bytes, "incorrect used bytes of the bucket")
+	assert.Equal(t, int64(8), stats.Buckets["a1b2c3"].MaxBytes, "incorrect quota of the bucket")
+
+	// lowering the quota evicts the files immediately
+	cache.SetQuotas([]*model.Bucket{{Folder: aws.String("a1b2c3"), CacheMaxBytes: aws.Int64(4)}})
+	_, _, hasA = cache.GetFile("a1b2c3/0.0.1/a.js")
+	_, _, hasC := cache.GetFile("a1b2c3/0.0.1/c.js")
+	assert.True(t, hasA, "most recently used file of the bucket must be kept")
+	assert.False(t, hasC, "least recently used file of the bucket must be evicted")
+	assert.Equal(t, int64(4), cache.Stats().Buckets["a1b2c3"].Bytes, "incorrect used bytes of the bucket")
+}
+
+func TestSharesContentOfFilesInDifferentVersions(t *testing.T) {
+	cache := newTestCache(t, config.Cache{})
+
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{ETag: aws.String("\"a\"")}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.2/a.js", &s3.GetObjectOutput{ETag: aws.String("\"a\"")}, []byte("aaaa"))
+	cache.SaveFile("d4e5f6/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("d4e5f6/0.0.2/a.js", &s3.GetObjectOutput{}, []byte("aaaa"))
+	cache.SaveFile("d4e5f6/0.0.2/b.js", &s3.GetObjectOutput{}, []byte("bbbb"))
+
+	stats := cache.Stats()
+	assert.Equal(t, 5, stats.Entries, "incorrect entry count")
+	assert.Equal(t, int64(12), stats.Bytes, "same content must be counted once")
+	assert.Equal(t, int64(4), stats.Buckets["a1b2c3"].Bytes, "incorrect used bytes of the bucket")
+	assert.Equal(t, int64(8), stats.Buckets["d4e5f6"].Bytes, "incorrect used bytes of the bucket")
+
+	content, _, _ := cache.GetFile("a1b2c3/0.0.2/a.js")
+	assert.Equal(t, "aaaa", string(content), "incorrect shared content")
+
+	// the content is kept until the last file that uses it is removed
+	assert.Equal(t, int64(0), cache.Purge("a1b2c3/0.0.1/", true).Bytes, "shared content must not be counted as purged")
+	cache.Purge("d4e5f6/0.0.1/", true)
+	assert.Equal(t, int64(12), cache.Stats().Bytes, "shared content must be kept")
+
+	cache.Purge("d4e5f6/0.0.2/a.js", false)
+	assert.Equal(t, int64(8), cache.Stats().Bytes, "incorrect used bytes")
+	assert.Equal(t, int64(4), cache.Purge("a1b2c3/", true).Bytes, "freed content must be counted as purged")
+	assert.Equal(t, int64(4), cache.Stats().Bytes, "content must be removed with the last file that uses it")
+}
+
+func TestKeepsVariantsOfTheSameContent(t *testing.T) {
+	cache := newTestCache(t, config.Cache{})
+
+	meta := &s3.GetObjectOutput{ETag: aws.String("v1")}
+	cache.SaveFile("a1b2c3/0.0.1/app.js", meta, []byte("content"))
+	cache.SaveFileVariant("a1b2c3/0.0.1/app.js", meta, "gzip", []byte("gz"))
+
+	variant, hasVariant := cache.GetFileVariant("a1b2c3/0.0.1/app.js", meta, "gzip")
+	assert.True(t, hasVariant, "variant must be cached")
+	assert.Equal(t, "gz", string(variant), "incorrect variant")
+	assert.Equal(t, int64(9), cache.Stats().Bytes, "variant size must be counted")
+
+	_, hasVariant = cache.GetFileVariant("a1b2c3/0.0.1/app.js", &s3.GetObjectOutput{ETag: aws.String("v1")}, "gzip")
+	assert.False(t, hasVariant, "variant must not be returned for another meta")
+
+	// renewing the same content keeps the variants
+	renewedMeta := &s3.GetObjectOutput{ETag: aws.String("v1")}
+	cache.SaveFile("a1b2c3/0.0.1/app.js", renewedMeta, []byte("content"))
+	_, hasVariant = cache.GetFileVariant("a1b2c3/0.0.1/app.js", renewedMeta, "gzip")
+	assert.True(t, hasVariant, "variant of the same content must be kept")
+
+	// modified content drops the variants
+	modifiedMeta := &s3.GetObjectOutput{ETag: aws.String("v2")}
+	cache.SaveFile("a1b2c3/0.0.1/app.js", modifiedMeta, []byte("modified"))
+	_, hasVariant = cache.GetFileVariant("a1b2c3/0.0.1/app.js", modifiedMeta, "gzip")
+	assert.False(t, hasVariant, "variant of the modified content must be dropped")
+	assert.Equal(t, int64(8), cache.Stats().Bytes, "incorrect used bytes")
+}
+
+func TestKeepsChunksNextToFiles(t *testing.T) {
+	cache := newTestCache(t, config.Cache{MaxBytes: 10})
+
+	meta := &s3.GetObjectOutput{ContentRange: aws.String("bytes 0-3/100")}
+	cache.SaveFile("a1b2c3/0.0.1/video.mp4", &s3.GetObjectOutput{}, []byte("file"))
+	cache.SaveFileChunk("a1b2c3/0.0.1/video.mp4", 0, meta, []byte("0123"))
+
+	chunk, chunkMeta, hasChunk := cache.GetFileChunk("a1b2c3/0.0.1/video.mp4", 0)
+	assert.True(t, hasChunk, "chunk must be cached")
+	assert.Equal(t, "0123", string(chunk), "incorrect chunk")
+	assert.Equal(t, meta, chunkMeta, "incorrect chunk meta")
+	_, _, hasFile := cache.GetFile("a1b2c3/0.0.1/video.mp4")
+	assert.True(t, hasFile, "file must be kept next to its chunk")
+
+	// the chunks share the size limit and the usage order with the files
+	cache.SaveFileChunk("a1b2c3/0.0.1/video.mp4", 1, meta, []byte("4567"))
+	_, _, hasChunk = cache.GetFileChunk("a1b2c3/0.0.1/video.mp4", 0)
+	assert.False(t, hasChunk, "least recently used chunk must be evicted")
+	assert.Equal(t, 2, cache.Stats().Entries, "incorrect entry count")
+
+	result := cache.Purge("a1b2c3/0.0.1/video.mp4", false)
+	assert.Equal(t, 2, result.Entries, "chunks must be purged with the file")
+	_, _, hasChunk = cache.GetFileChunk("a1b2c3/0.0.1/video.mp4", 1)
+	assert.False(t, hasChunk, "chunk must be purged")
+}
+
+func TestLoadsSnapshotOfActiveBuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filemapcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := newTestCache(t, config.Cache{})
+	cache.SaveFile("a1b2c3/0.0.1/a.js", &s3.GetObjectOutput{ETag: aws.String("\"a\"")}, []byte("aaaa"))
+	cache.SaveFile("a1b2c3/0.0.0/a.js", &s3.GetObjectOutput{}, []byte("old"))
+	cache.SaveFileChunk("a1b2c3/0.0.1/b.mp4", 1, &s3.GetObjectOutput{}, []byte("bb"))
+	cache.SaveMissingFile("a1b2c3/0.0.1/wp-admin")
+	cache.SaveFile("d4e5f6/0.0.1/a.js", &s3.GetObjectOutput{}, []byte("uploaded-before"))
+
+	buckets := []*model.Bucket{{
+		Folder:         aws.String("a1b2c3"),
+		Version:        aws.String("0.0.1"),
+		Status:         aws.String("active"),
+		IsCacheEnabled: aws.Bool(true),
+		Revision:       1,
+	}, {
+		Folder:         aws.String("d4e5f6"),
+		Version:        aws.String("0.0.1"),
+		Status:         aws.String("active"),
+		IsCacheEnabled: aws.Bool(true),
+		Revision:       1,
+	}}
+	assert.Nil(t, cache.SaveSnapshot(dir, buckets))
+
+	// the files of the bucket are uploaded again while the server is down
+	uploadedBucket := *buckets[1]
+	uploadedBucket.Revision = 2
+	buckets[1] = &uploadedBucket
+
+	restarted := newTestCache(t, config.Cache{})
+	assert.Nil(t, restarted.LoadSnapshot(dir, buckets))
+
+	content, meta, hasA := restarted.GetFile("a1b2c3/0.0.1/a.js")
+	assert.True(t, hasA, "file of the active version must be loaded")
+	assert.Equal(t, "aaaa", string(content))
+	assert.Equal(t, "\"a\"", aws.StringValue(meta.ETag))
+	_, _, hasChunk := restarted.GetFileChunk("a1b2c3/0.0.1/b.mp4", 1)
+	assert.True(t, hasChunk, "chunk of the active version must be loaded")
+	_, _, hasOld := restarted.GetFile("a1b2c3/0.0.0/a.js")
+	assert.False(t, hasOld, "file of the old version must be skipped")
+	assert.False(t, restarted.IsFileMissing("a1b2c3/0.0.1/wp-admin"), "missing file must not be saved")
+	_, _, hasUploaded := restarted.GetFile("d4e5f6/0.0.1/a.js")
+	assert.False(t, hasUploaded, "file of the bucket with a different revision must be skipped")
+
+	_, err = os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.True(t, os.IsNotExist(err), "snapshot must be removed after loading")
+}
+
+func TestKeepsContentAndMetaConsistentUnderConcurrentLoad(t *testing.T) {
+	cache := newTestCache(t, config.Cache{MaxBytes: 64, NotFoundTTL: time.Minute, LargeFileTTL: time.Minute})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				path := fmt.Sprintf("a1b2c3/0.0.1/%d.js", i%8)
+				content := fmt.Sprintf("%d-%d", worker, i)
+
+				switch i % 10 {
+				case 0:
+					cache.Reset()
+				case 1:
+					cache.SaveLargeFile(path)
+				case 2:
+					cache.Purge("a1b2c3/", true)
+				case 3:
+					cache.SaveMissingFile(path)
+				case 4:
+					cache.Stats()
+				default:
+					// the ETag is the content to verify that the meta belongs to the content
+					cache.SaveFile(path, &s3.GetObjectOutput{ETag: aws.String(content)}, []byte(content))
+				}
+
+				buff, meta, hasCache := cache.GetFile(path)
+				if hasCache {
+					assert.Equal(t, string(buff), aws.StringValue(meta.ETag), "content and meta must match")
+				}
+				cache.IsFileMissing(path)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	assert.True(t, stats.Bytes <= 64, "cache must not exceed the size limit")
+}
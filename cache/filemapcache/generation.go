@@ -0,0 +1,306 @@
+package filemapcache
+
+import (
+	"container/list"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/sepet-cdn/cache"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generation is a set of cache entries that's replaced as a whole when the cache is reset
+type generation struct {
+	// lock guards all the fields of the generation
+	lock sync.Mutex
+
+	// entries maps the file paths to their elements in the usage list
+	entries map[string]*list.Element
+
+	// chunks maps the chunks of the files to their elements in the usage list. The chunks share the usage
+	// list with the whole files.
+	chunks map[chunkKey]*list.Element
+
+	// usage keeps the entries ordered by their last access, the most recently used entry is at the front
+	usage *list.List
+
+	// usedBytes is the total size of the entries. The content of a blob is counted once.
+	usedBytes int64
+
+	// blobs maps the blob keys to the contents shared by the entries
+	blobs map[string]*blob
+
+	// folders keeps the usage of the entries by their bucket folders to enforce the bucket quotas
+	folders map[string]*folderUsage
+}
+
+// folderUsage is the usage of the entries of a bucket folder
+type folderUsage struct {
+	// usage keeps the entries of the folder ordered by their last access like the usage list of the generation
+	usage *list.List
+
+	// usedBytes is the total size of the entries of the folder. The content of a blob is counted once.
+	usedBytes int64
+}
+
+// chunkKey identifies a fixed-size part of a file
+type chunkKey struct {
+	path  string
+	index int64
+}
+
+// entry is a cached file with its content and meta, a chunk of a file or a record of a file that's not found
+type entry struct {
+	path    string
+	content []byte
+	meta    *s3.GetObjectOutput
+
+	// blobKey is the key of the blob that keeps the content. It's empty if the entry doesn't have content.
+	blobKey string
+
+	// folder is the bucket folder of the path and folderElement is the entry's element in the folder's usage list
+	folder        string
+	folderElement *list.Element
+
+	// isChunk is true if the content is the chunk of the file at the chunk index
+	isChunk    bool
+	chunkIndex int64
+
+	// variants keeps the encoded variants of the content like the gzip compressed one by their encodings
+	variants map[string][]byte
+
+	// size is the total size of the content and the variants. The content may be shared with the other entries.
+	size int64
+
+	// savedAt is the time the entry is saved into the cache
+	savedAt time.Time
+
+	// expiresAt is the time the entry becomes stale. Zero means the entry never expires.
+	expiresAt time.Time
+
+	// isMissing is true if the entry records that the file is not found. The missing files
+	// don't have content or meta.
+	isMissing bool
+
+	// isTooLarge is true if the entry records that the file is too large to be cached. Like the missing
+	// files, the large files don't have content or meta.
+	isTooLarge bool
+}
+
+// isRecord returns true if the entry records the state of the file instead of keeping its content
+func (e *entry) isRecord() bool {
+	return e.isMissing || e.isTooLarge
+}
+
+func newGeneration() *generation {
+	return &generation{
+		entries: map[string]*list.Element{},
+		chunks:  map[chunkKey]*list.Element{},
+		usage:   list.New(),
+		blobs:   map[string]*blob{},
+		folders: map[string]*folderUsage{},
+	}
+}
+
+// get returns the entry and moves it to the front of the usage list. The lock must be held by the caller.
+func (g *generation) get(path string) (*entry, bool) {
+	element, exists := g.entries[path]
+	if !exists {
+		return nil, false
+	}
+	return g.touch(element), true
+}
+
+// peek returns the entry without changing its place in the usage list. The lock must be held by the caller.
+func (g *generation) peek(path string) (*entry, bool) {
+	element, exists := g.entries[path]
+	if !exists {
+		return nil, false
+	}
+	return element.Value.(*entry), true
+}
+
+// getChunk returns the chunk entry and moves it to the front of the usage list. The lock must be held by the caller.
+func (g *generation) getChunk(key chunkKey) (*entry, bool) {
+	element, exists := g.chunks[key]
+	if !exists {
+		return nil, false
+	}
+	return g.touch(element), true
+}
+
+// add puts the entry to the front of the usage list by replacing the existing entry with the same path
+// or the same chunk. The lock must be held by the caller.
+func (g *generation) add(e *entry) {
+	if e.isChunk {
+		key := chunkKey{path: e.path, index: e.chunkIndex}
+		g.removeChunk(key)
+		g.chunks[key] = g.link(e)
+	} else {
+		g.remove(e.path)
+		g.entries[e.path] = g.link(e)
+	}
+}
+
+// removeEntry deletes the file or the chunk entry. The lock must be held by the caller.
+func (g *generation) removeEntry(e *entry) {
+	if e.isChunk {
+		g.removeChunk(chunkKey{path: e.path, index: e.chunkIndex})
+	} else {
+		g.remove(e.path)
+	}
+}
+
+// removeChunk deletes the chunk entry. The lock must be held by the caller.
+func (g *generation) removeChunk(key chunkKey) {
+	element, exists := g.chunks[key]
+	if !exists {
+		return
+	}
+
+	g.unlink(element)
+	delete(g.chunks, key)
+}
+
+// remove deletes the entry. The lock must be held by the caller.
+func (g *generation) remove(path string) (*entry, bool) {
+	element, exists := g.entries[path]
+	if !exists {
+		return nil, false
+	}
+
+	e := g.unlink(element)
+	delete(g.entries, path)
+	return e, true
+}
+
+// link puts the entry to the front of the usage lists and adds its size to the used bytes. The content is
+// shared with the entries that have the same blob key. The lock must be held by the caller.
+func (g *generation) link(e *entry) *list.Element {
+	e.folder = cache.GetBucketFolder(e.path)
+	folder, exists := g.folders[e.folder]
+	if !exists {
+		folder = &folderUsage{usage: list.New()}
+		g.folders[e.folder] = folder
+	}
+	e.folderElement = folder.usage.PushFront(e)
+
+	addedBytes, addedFolderBytes := g.retainBlob(e)
+	variantBytes := e.size - int64(len(e.content))
+	folder.usedBytes += addedFolderBytes + variantBytes
+	g.usedBytes += addedBytes + variantBytes
+	return g.usage.PushFront(e)
+}
+
+// unlink removes the entry of the element from the usage lists and subtracts its size from the used bytes.
+// The lock must be held by the caller.
+func (g *generation) unlink(element *list.Element) *entry {
+	e := element.Value.(*entry)
+	removedBytes, removedFolderBytes := g.releaseBlob(e)
+	variantBytes := e.size - int64(len(e.content))
+
+	folder := g.folders[e.folder]
+	folder.usage.Remove(e.folderElement)
+	folder.usedBytes -= removedFolderBytes + variantBytes
+	if folder.usage.Len() == 0 {
+		delete(g.folders, e.folder)
+	}
+
+	g.usedBytes -= removedBytes + variantBytes
+	g.usage.Remove(element)
+	return e
+}
+
+// touch moves the entry of the element to the front of the usage lists. The lock must be held by the caller.
+func (g *generation) touch(element *list.Element) *entry {
+	e := element.Value.(*entry)
+	g.folders[e.folder].usage.MoveToFront(e.folderElement)
+	g.usage.MoveToFront(element)
+	return e
+}
+
+// leastRecentlyUsed returns the entry at the back of the usage list. The lock must be held by the caller.
+func (g *generation) leastRecentlyUsed() (*entry, bool) {
+	element := g.usage.Back()
+	if element == nil {
+		return nil, false
+	}
+	return element.Value.(*entry), true
+}
+
+// leastRecentlyUsedInFolder returns the least recently used entry of the bucket folder. The lock must be held
+// by the caller.
+func (g *generation) leastRecentlyUsedInFolder(folder string) (*entry, bool) {
+	usage, exists := g.folders[folder]
+	if !exists {
+		return nil, false
+	}
+	return usage.usage.Back().Value.(*entry), true
+}
+
+// folderBytes returns the total size of the entries of the bucket folder. The lock must be held by the caller.
+func (g *generation) folderBytes(folder string) int64 {
+	if usage, exists := g.folders[folder]; exists {
+		return usage.usedBytes
+	}
+	return 0
+}
+
+// setVariant puts the encoded variant of the content into the entry. The lock must be held by the caller.
+func (g *generation) setVariant(e *entry, encoding string, buff []byte) {
+	if e.variants == nil {
+		e.variants = map[string][]byte{}
+	}
+	sizeDiff := int64(len(buff) - len(e.variants[encoding]))
+	e.variants[encoding] = buff
+	e.size += sizeDiff
+	g.usedBytes += sizeDiff
+	g.folders[e.folder].usedBytes += sizeDiff
+}
+
+// find returns the entries of the file with the exact path or all the entries starting with the path if
+// isPrefix is true. The chunks of the files are included. The lock must be held by the caller.
+func (g *generation) find(path string, isPrefix bool) []*entry {
+	entries := make([]*entry, 0)
+	if !isPrefix {
+		if element, exists := g.entries[path]; exists {
+			entries = append(entries, element.Value.(*entry))
+		}
+	} else {
+		for entryPath, element := range g.entries {
+			if strings.HasPrefix(entryPath, path) {
+				entries = append(entries, element.Value.(*entry))
+			}
+		}
+	}
+
+	for key, element := range g.chunks {
+		if key.path == path || (isPrefix && strings.HasPrefix(key.path, path)) {
+			entries = append(entries, element.Value.(*entry))
+		}
+	}
+	return entries
+}
+
+// all returns all the entries including the chunks. The lock must be held by the caller.
+func (g *generation) all() []*entry {
+	entries := make([]*entry, 0, len(g.entries)+len(g.chunks))
+	for _, element := range g.entries {
+		entries = append(entries, element.Value.(*entry))
+	}
+	for _, element := range g.chunks {
+		entries = append(entries, element.Value.(*entry))
+	}
+	return entries
+}
+
+// hasSameContent returns true if the entries are created for the same version of the file
+func hasSameContent(e, other *entry) bool {
+	if e.meta == other.meta {
+		return true
+	}
+	if e.meta == nil || other.meta == nil || e.meta.ETag == nil || other.meta.ETag == nil {
+		return false
+	}
+	return *e.meta.ETag == *other.meta.ETag && len(e.content) == len(other.content)
+}
@@ -0,0 +1,189 @@
+package filemapcache
+
+import (
+	"bufio"
+	"encoding/gob"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotFileName is the name of the snapshot file in the snapshot directory
+const snapshotFileName = "filemapcache.snapshot"
+
+// snapshotHeader is written before the entries. It keeps the revisions of the buckets by their folders when
+// the snapshot is saved to skip the entries of the buckets that are uploaded again until it's loaded.
+type snapshotHeader struct {
+	BucketRevisions map[string]int
+}
+
+// snapshotEntry is the serialized form of a cached file or chunk. The meta is kept as JSON since
+// it can't be encoded with gob.
+type snapshotEntry struct {
+	Path       string
+	Content    []byte
+	Meta       []byte
+	IsChunk    bool
+	ChunkIndex int64
+	SavedAt    time.Time
+	ExpiresAt  time.Time
+}
+
+// SaveSnapshot writes the cached files and chunks into the directory to be loaded by LoadSnapshot after
+// the restart with the revisions of the given buckets. The missing file records and the encoded variants
+// are not saved.
+func (mc *FileMapCache) SaveSnapshot(dir string, buckets []*model.Bucket) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// the entries are written from the least recently used one to load them in the same usage order
+	g := mc.generation()
+	g.lock.Lock()
+	entries := make([]*entry, 0, g.usage.Len())
+	for element := g.usage.Back(); element != nil; element = element.Prev() {
+		e := element.Value.(*entry)
+		if !e.isRecord() {
+			entries = append(entries, e)
+		}
+	}
+	g.lock.Unlock()
+
+	snapshotPath := filepath.Join(dir, snapshotFileName)
+	tmpFile, err := os.Create(snapshotPath + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	encoder := gob.NewEncoder(writer)
+	err = encoder.Encode(snapshotHeader{BucketRevisions: cache.GetBucketRevisions(buckets)})
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = encodeSnapshotEntry(encoder, entries[i])
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), snapshotPath); err != nil {
+		return err
+	}
+
+	mc.logger.WithFields(logrus.Fields{
+		"entries": len(entries),
+		"path":    snapshotPath,
+	}).Info("saved-cache-snapshot")
+	return nil
+}
+
+// LoadSnapshot loads the entries saved by SaveSnapshot. Only the entries that can stay in the cache for the
+// given buckets are loaded, the others belong to the removed buckets, the old versions or the buckets whose
+// revisions are changed since the snapshot is saved. The snapshot is removed after it's loaded to not load
+// the same entries again after a crash.
+func (mc *FileMapCache) LoadSnapshot(dir string, buckets []*model.Bucket) error {
+	snapshotPath := filepath.Join(dir, snapshotFileName)
+	file, err := os.Open(snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(snapshotPath)
+	defer file.Close()
+
+	decoder := gob.NewDecoder(bufio.NewReader(file))
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+
+	pathPrefixesToKeep := cache.GetPathPrefixesToKeep(buckets)
+	bucketRevisions := cache.GetBucketRevisions(buckets)
+	loaded, skipped := 0, 0
+	for {
+		var se snapshotEntry
+		err := decoder.Decode(&se)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		folder := cache.GetBucketFolder(se.Path)
+		if !cache.HasAnyPrefix(se.Path, pathPrefixesToKeep) || header.BucketRevisions[folder] != bucketRevisions[folder] {
+			skipped++
+			continue
+		}
+
+		e, err := decodeSnapshotEntry(&se)
+		if err != nil {
+			return err
+		}
+		mc.add(e)
+		loaded++
+	}
+
+	mc.logger.WithFields(logrus.Fields{
+		"loaded":  loaded,
+		"skipped": skipped,
+		"path":    snapshotPath,
+	}).Info("loaded-cache-snapshot")
+	return nil
+}
+
+func encodeSnapshotEntry(encoder *gob.Encoder, e *entry) error {
+	var metaContent []byte
+	if e.meta != nil {
+		var err error
+		metaContent, err = cache.MarshalMeta(e.meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	return encoder.Encode(snapshotEntry{
+		Path:       e.path,
+		Content:    e.content,
+		Meta:       metaContent,
+		IsChunk:    e.isChunk,
+		ChunkIndex: e.chunkIndex,
+		SavedAt:    e.savedAt,
+		ExpiresAt:  e.expiresAt,
+	})
+}
+
+func decodeSnapshotEntry(se *snapshotEntry) (*entry, error) {
+	var meta *s3.GetObjectOutput
+	if se.Meta != nil {
+		var err error
+		meta, err = cache.UnmarshalMeta(se.Meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &entry{
+		path:       se.Path,
+		content:    se.Content,
+		meta:       meta,
+		isChunk:    se.IsChunk,
+		chunkIndex: se.ChunkIndex,
+		size:       int64(len(se.Content)),
+		savedAt:    se.SavedAt,
+		expiresAt:  se.ExpiresAt,
+	}, nil
+}
@@ -0,0 +1,23 @@
+package cache
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// MarshalMeta serializes the file meta as JSON to be saved or sent to the peers. The body is left out since
+// it's already read or being streamed and it can't be serialized.
+func MarshalMeta(meta *s3.GetObjectOutput) ([]byte, error) {
+	metaCopy := *meta
+	metaCopy.Body = nil
+	return json.Marshal(metaCopy)
+}
+
+// UnmarshalMeta parses the file meta serialized by MarshalMeta
+func UnmarshalMeta(content []byte) (*s3.GetObjectOutput, error) {
+	meta := &s3.GetObjectOutput{}
+	if err := json.Unmarshal(content, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/model"
+	"strings"
+)
+
+// GetPathPrefixesToKeep returns the path prefixes of the files that can stay in the cache for the given buckets
+func GetPathPrefixesToKeep(buckets []*model.Bucket) map[string]bool {
+	pathPrefixesToKeep := map[string]bool{}
+	for _, bucket := range buckets {
+		if core.StringValue(bucket.Status) != "active" || !core.BoolValue(bucket.IsCacheEnabled) {
+			// skip the bucket if the status is not active or caching is not enabled
+			continue
+		}
+
+		if core.StringValue(bucket.VersionIdentifier) == "path" {
+			// if the version identifier is path, files from different versions may have been cached.
+			// we need to keep the files from all the versions of the bucket.
+			// so keep all the paths starting for the bucket.
+			prefix := core.StringValue(bucket.Folder) + "/"
+			pathPrefixesToKeep[prefix] = true
+			continue
+		}
+
+		// keep the files of the active version of the bucket
+		// this will remove the cache for older version if the version is changed
+		prefix := core.StringValue(bucket.Folder) + "/" + core.StringValue(bucket.Version)
+		pathPrefixesToKeep[prefix] = true
+	}
+	return pathPrefixesToKeep
+}
+
+// GetBucketRevisions returns the revisions of the buckets by their folders. The cached files of a bucket are
+// outdated if its revision is changed since they're saved.
+func GetBucketRevisions(buckets []*model.Bucket) map[string]int {
+	revisions := map[string]int{}
+	for _, bucket := range buckets {
+		revisions[core.StringValue(bucket.Folder)] = bucket.Revision
+	}
+	return revisions
+}
+
+// HasAnyPrefix returns true if the path starts with any of the prefixes
+func HasAnyPrefix(path string, prefixes map[string]bool) bool {
+	for prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package cache
+
+import (
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/model"
+)
+
+// GetBucketQuotas returns the cache size limits of the buckets by their folders. The buckets that don't
+// have a limit are not included.
+func GetBucketQuotas(buckets []*model.Bucket) map[string]int64 {
+	quotas := map[string]int64{}
+	for _, bucket := range buckets {
+		if bucket.CacheMaxBytes == nil || *bucket.CacheMaxBytes <= 0 {
+			continue
+		}
+		quotas[core.StringValue(bucket.Folder)] = *bucket.CacheMaxBytes
+	}
+	return quotas
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"strings"
+	"time"
+)
+
+// IFileCacheInspector defines the functionality of inspecting the content of the file cache
+type IFileCacheInspector interface {
+	// Stats returns the statistics of the cache and the buckets in it
+	Stats() Stats
+
+	// Entries returns the cached entries that have the paths starting with the prefix ordered by their paths
+	Entries(prefix string) []EntryInfo
+}
+
+// Stats contains the statistics of the file cache
+type Stats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+
+	// OldestEntryAge is the age of the oldest entry in seconds
+	OldestEntryAge int64 `json:"oldestEntryAge"`
+
+	// Buckets contains the statistics of the buckets by their folders
+	Buckets map[string]*BucketStats `json:"buckets"`
+}
+
+// BucketStats contains the statistics of a bucket's files in the file cache
+type BucketStats struct {
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+
+	// OldestEntryAge is the age of the oldest entry in seconds
+	OldestEntryAge int64 `json:"oldestEntryAge"`
+}
+
+// EntryInfo contains the information of a cached entry
+type EntryInfo struct {
+	Path      string     `json:"path"`
+	Bytes     int64      `json:"bytes"`
+	SavedAt   time.Time  `json:"savedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// IsMissing is true if the entry records that the file is not found
+	IsMissing bool `json:"isMissing,omitempty"`
+
+	// IsTooLarge is true if the entry records that the file is too large to be cached
+	IsTooLarge bool `json:"isTooLarge,omitempty"`
+
+	// ChunkIndex is the index of the chunk if the entry is a fixed-size part of the file
+	ChunkIndex *int64 `json:"chunkIndex,omitempty"`
+}
+
+// GetBucketFolder returns the folder of the bucket from the file path. Returns "a1b2c3" for "a1b2c3/0.0.1/index.html"
+func GetBucketFolder(path string) string {
+	slashIndex := strings.IndexByte(path, '/')
+	if slashIndex < 0 {
+		return path
+	}
+	return path[:slashIndex]
+}
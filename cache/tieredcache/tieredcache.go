@@ -0,0 +1,148 @@
+package tieredcache
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/model"
+	"time"
+)
+
+// TieredCache implements IFileCache interface by chaining multiple caches. The files missing in a cache
+// are looked up in the next one and they are copied into the previous caches when they are found.
+type TieredCache struct {
+	Caches []cache.IFileCache
+}
+
+// New generates new TieredCache. The caches are looked up in the given order.
+func New(caches ...cache.IFileCache) *TieredCache {
+	return &TieredCache{
+		Caches: caches,
+	}
+}
+
+func (tc *TieredCache) GetFile(path string) ([]byte, *s3.GetObjectOutput, bool) {
+	for i, fileCache := range tc.Caches {
+		expiringCache, isExpiring := fileCache.(cache.IExpiringFileCache)
+
+		var buff []byte
+		var meta *s3.GetObjectOutput
+		var expiresAt time.Time
+		var hasCache bool
+		if isExpiring {
+			buff, meta, expiresAt, hasCache = expiringCache.GetFileWithExpiry(path)
+		} else {
+			buff, meta, hasCache = fileCache.GetFile(path)
+		}
+		if !hasCache {
+			continue
+		}
+
+		// promote the file to the faster caches, the file keeps its expiry if it's known
+		for j := 0; j < i; j++ {
+			if fasterCache, isFasterExpiring := tc.Caches[j].(cache.IExpiringFileCache); isExpiring && isFasterExpiring {
+				fasterCache.SaveFileWithExpiry(path, meta, buff, expiresAt)
+			} else {
+				tc.Caches[j].SaveFile(path, meta, buff)
+			}
+		}
+		return buff, meta, true
+	}
+	return nil, nil, false
+}
+
+// GetStaleFile returns the file from the first cache that has it. Stale files aren't copied into
+// the previous caches since saving a file renews its expiry.
+func (tc *TieredCache) GetStaleFile(path string) ([]byte, *s3.GetObjectOutput, time.Duration, bool) {
+	for _, fileCache := range tc.Caches {
+		buff, meta, staleness, hasCache := fileCache.GetStaleFile(path)
+		if hasCache {
+			return buff, meta, staleness, true
+		}
+	}
+	return nil, nil, 0, false
+}
+
+func (tc *TieredCache) SaveFile(path string, data *s3.GetObjectOutput, buff []byte) {
+	for _, fileCache := range tc.Caches {
+		fileCache.SaveFile(path, data, buff)
+	}
+}
+
+// GetFileVariant returns the variant from the first cache that has it
+func (tc *TieredCache) GetFileVariant(path string, meta *s3.GetObjectOutput, encoding string) ([]byte, bool) {
+	for _, fileCache := range tc.Caches {
+		buff, hasVariant := fileCache.GetFileVariant(path, meta, encoding)
+		if hasVariant {
+			return buff, true
+		}
+	}
+	return nil, false
+}
+
+func (tc *TieredCache) SaveFileVariant(path string, meta *s3.GetObjectOutput, encoding string, buff []byte) {
+	for _, fileCache := range tc.Caches {
+		fileCache.SaveFileVariant(path, meta, encoding, buff)
+	}
+}
+
+// GetFileChunk returns the chunk from the first cache that has it
+func (tc *TieredCache) GetFileChunk(path string, index int64) ([]byte, *s3.GetObjectOutput, bool) {
+	for _, fileCache := range tc.Caches {
+		buff, meta, hasChunk := fileCache.GetFileChunk(path, index)
+		if hasChunk {
+			return buff, meta, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (tc *TieredCache) SaveFileChunk(path string, index int64, meta *s3.GetObjectOutput, buff []byte) {
+	for _, fileCache := range tc.Caches {
+		fileCache.SaveFileChunk(path, index, meta, buff)
+	}
+}
+
+func (tc *TieredCache) SaveMissingFile(path string) {
+	for _, fileCache := range tc.Caches {
+		fileCache.SaveMissingFile(path)
+	}
+}
+
+func (tc *TieredCache) IsFileMissing(path string) bool {
+	for _, fileCache := range tc.Caches {
+		if fileCache.IsFileMissing(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tc *TieredCache) SaveLargeFile(path string) {
+	for _, fileCache := range tc.Caches {
+		fileCache.SaveLargeFile(path)
+	}
+}
+
+func (tc *TieredCache) IsFileTooLarge(path string) bool {
+	for _, fileCache := range tc.Caches {
+		if fileCache.IsFileTooLarge(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tc *TieredCache) SetQuotas(buckets []*model.Bucket) {
+	for _, fileCache := range tc.Caches {
+		fileCache.SetQuotas(buckets)
+	}
+}
+
+// Purge removes the files from all the caches and returns the total of the removed entries and bytes
+func (tc *TieredCache) Purge(path string, isPrefix bool) cache.PurgeResult {
+	result := cache.PurgeResult{}
+	for _, fileCache := range tc.Caches {
+		result = result.Add(fileCache.Purge(path, isPrefix))
+	}
+	return result
+}
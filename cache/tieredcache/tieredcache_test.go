@@ -0,0 +1,48 @@
+package tieredcache
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache/filediskcache"
+	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeepsExpiryOfPromotedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-disk-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	memoryCache, err := filemapcache.New(ctx, config.Cache{ResetInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskCache, err := filediskcache.New(ctx, dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tieredCache := New(memoryCache, diskCache)
+
+	// the file is saved an hour ago with one minute left
+	expiresAt := time.Now().Add(time.Minute)
+	diskCache.SaveFileWithExpiry("a1b2c3/0.0.1/app.js", &s3.GetObjectOutput{CacheControl: aws.String("max-age=3660")}, []byte("app"), expiresAt)
+
+	buff, _, hasCache := tieredCache.GetFile("a1b2c3/0.0.1/app.js")
+	assert.True(t, hasCache, "file must be found on the disk")
+	assert.Equal(t, []byte("app"), buff, "incorrect content")
+
+	_, _, promotedExpiresAt, isPromoted := memoryCache.GetFileWithExpiry("a1b2c3/0.0.1/app.js")
+	assert.True(t, isPromoted, "file must be promoted to the memory")
+	assert.True(t, expiresAt.Equal(promotedExpiresAt), "promoted file must keep its expiry")
+}
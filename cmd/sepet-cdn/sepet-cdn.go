@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"github.com/devingen/sepet-cdn/config"
 	"github.com/devingen/sepet-cdn/server"
 	"github.com/kelseyhightower/envconfig"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -16,8 +20,22 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	srv := server.New(appConfig)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Listen and serve failed %s", err.Error())
+	srv, onShutdown := server.New(appConfig)
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Listen and serve failed %s", err.Error())
+		}
+	}()
+
+	// wait for the stop signal and complete the active requests before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown failed %s", err.Error())
 	}
+	onShutdown()
 }
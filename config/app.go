@@ -7,14 +7,18 @@ type App struct {
 	// Port is the port of the HTTP server.
 	Port string `envconfig:"port" default:"80"`
 
+	// ShutdownTimeout is the time limit of completing the active requests on shutdown.
+	ShutdownTimeout time.Duration `envconfig:"shutdown_timeout" default:"30s"`
+
 	// LogLevel defines the log level.
 	LogLevel string `envconfig:"log_level" default:"info"`
 
 	// DalUpdateInterval is the data refresh time interval.
 	DalUpdateInterval time.Duration `envconfig:"dal_update_interval" default:"1m"`
 
-	// CacheResetInterval is the data clean time interval.
-	CacheResetInterval time.Duration `envconfig:"cache_reset_interval" default:"1h"`
+	// DalBackupFile is the file that the buckets are written into after each sync with the Sepet API. The buckets
+	// are loaded from the file if the API is unreachable on startup. The backup is disabled if it's empty.
+	DalBackupFile string `envconfig:"dal_backup_file" default:""`
 
 	// ApiURL is the URL of the Sepet API to get buckets.
 	ApiURL string `envconfig:"api_url" required:"true"`
@@ -22,10 +26,116 @@ type App struct {
 	// ApiKey is the key for Sepet API to get buckets.
 	ApiKey string `envconfig:"api_key" default:""`
 
+	// RootDomains are the domains that the buckets are served under by their domains like 'sepet.devingen.io'
+	// for 'acme.sepet.devingen.io'. The requests to the other hosts are rejected unless the host is a custom
+	// hostname of a bucket. The first label of any host is used as the bucket domain if it's set to empty
+	// explicitly, which lets any host pointing to the CDN resolve the buckets.
+	RootDomains []string `envconfig:"root_domains" default:"sepet.devingen.io"`
+
+	// AdminApiKey is the key that must be sent in the 'api-key' header of the admin requests like purging the cache.
+	// The admin endpoints are disabled if it's empty.
+	AdminApiKey string `envconfig:"admin_api_key" default:""`
+
+	// WebhookApiKey is the key that the Sepet API must send in the 'api-key' header of the webhook requests
+	// like notifying the bucket updates. The webhook endpoints are disabled if it's empty.
+	WebhookApiKey string `envconfig:"webhook_api_key" default:""`
+
+	// Cache is the configuration of the file cache.
+	Cache Cache `envconfig:"cache"`
+
+	// Cluster is the configuration of sharing the cache with the other CDN nodes.
+	Cluster Cluster `envconfig:"cluster"`
+
+	// Compression is the configuration of the response compression.
+	Compression Compression `envconfig:"compression"`
+
 	// S3 is the configuration of the S3 server.
 	S3 S3 `envconfig:"s3"`
 }
 
+// Cache defines the environment variable configuration for the file cache
+type Cache struct {
+	// ResetInterval is the data clean time interval. The files on the disk are revalidated after it as well.
+	ResetInterval time.Duration `envconfig:"reset_interval" default:"1h"`
+
+	// MaxBytes is the total size of the file contents that can be kept in the cache. The least recently
+	// used files are evicted when the limit is exceeded. The cache size is unlimited if it's 0.
+	MaxBytes int64 `envconfig:"max_bytes" default:"536870912"`
+
+	// MaxObjectBytes is the size limit of a single file to be cached. Larger files are served
+	// without being cached. There is no limit if it's 0.
+	MaxObjectBytes int64 `envconfig:"max_object_bytes" default:"16777216"`
+
+	// ChunkBytes is the size of the chunks that the range requests of the files larger than MaxObjectBytes are
+	// cached in. Only the requested chunks of the large files like videos are kept in the cache. The range
+	// requests of the large files are not cached if it's 0.
+	ChunkBytes int64 `envconfig:"chunk_bytes" default:"1048576"`
+
+	// ChunkWindow is the number of chunks from the first requested chunk that are cached for a range request.
+	// The rest of the long and open ended ranges like 'bytes=0-' are served without being cached to keep a
+	// single viewer of a large video from evicting the whole cache. There is no limit if it's 0.
+	ChunkWindow int64 `envconfig:"chunk_window" default:"8"`
+
+	// StaleWhileRevalidate is how long an expired file can be served while it's being refreshed in the background.
+	StaleWhileRevalidate time.Duration `envconfig:"stale_while_revalidate" default:"1m"`
+
+	// StaleIfError is how long an expired file can be served when the file server fails to return the file.
+	StaleIfError time.Duration `envconfig:"stale_if_error" default:"1h"`
+
+	// NotFoundTTL is how long the files that are not found are remembered to answer the repeated requests
+	// without going to the file server. The missing files are not remembered if it's 0.
+	NotFoundTTL time.Duration `envconfig:"not_found_ttl" default:"30s"`
+
+	// LargeFileTTL is how long the files that are too large to be cached are remembered to stream them without
+	// trying to fetch them into the memory first. The large files are not remembered if it's 0.
+	LargeFileTTL time.Duration `envconfig:"large_file_ttl" default:"5m"`
+
+	// SnapshotDir is the directory that the memory cache is saved into on shutdown and loaded from on startup
+	// to not start with an empty cache after the restarts. The snapshot is disabled if it's empty.
+	SnapshotDir string `envconfig:"snapshot_dir" default:""`
+
+	// DiskDir is the directory of the disk cache that's used when the files are not found in the memory.
+	// The disk cache is disabled if it's empty.
+	DiskDir string `envconfig:"disk_dir" default:""`
+
+	// DiskMaxBytes is the total size of the file contents that can be kept in the disk cache.
+	// The disk cache size is unlimited if it's 0.
+	DiskMaxBytes int64 `envconfig:"disk_max_bytes" default:"10737418240"`
+}
+
+// Cluster defines the environment variable configuration for sharing the cache between the CDN nodes. Each file
+// is owned by one node and the other nodes get the file from its owner instead of the file server.
+type Cluster struct {
+	// Peers is the comma separated list of the URLs of all the CDN nodes in the cluster including this node like
+	// 'http://10.0.0.1,http://10.0.0.2'. The cache is not shared if it's empty.
+	Peers []string `envconfig:"peers"`
+
+	// Self is the URL of this node in the peer list.
+	Self string `envconfig:"self"`
+
+	// Key is the key that the peer requests must have in the 'peer-key' header. It's required if the peers
+	// are given.
+	Key string `envconfig:"key" default:""`
+
+	// Timeout is the time limit of getting a file from a peer. The file is fetched from the file server
+	// when the peer doesn't respond in time.
+	Timeout time.Duration `envconfig:"timeout" default:"5s"`
+
+	// Backoff is how long a peer is skipped after it fails to return a file. The files it owns are fetched
+	// from the file server meanwhile instead of waiting for the peer that may be down.
+	Backoff time.Duration `envconfig:"backoff" default:"10s"`
+}
+
+// Compression defines the environment variable configuration for compressing the responses with gzip or Brotli
+type Compression struct {
+	// Enabled defines whether the text based files are compressed for the clients that accept it.
+	Enabled bool `envconfig:"enabled" default:"true"`
+
+	// MinBytes is the minimum file size to be compressed. Smaller files are served as is since
+	// compressing them doesn't save much.
+	MinBytes int `envconfig:"min_bytes" default:"1024"`
+}
+
 // S3 defines the environment variable configuration for AWS S3 or MinIO
 type S3 struct {
 	// Endpoint is the URL of the file server to connect to. If empty, the connection is made to the AWS S3 servers.
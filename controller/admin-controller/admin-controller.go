@@ -0,0 +1,46 @@
+package admincont
+
+import (
+	"context"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/sirupsen/logrus"
+)
+
+// IPeerPurger defines the functionality of forwarding the purges to the other nodes of the cluster
+type IPeerPurger interface {
+	PurgePeers(ctx context.Context, path string, isPrefix bool) error
+}
+
+// AdminController implements IAdminController interface
+type AdminController struct {
+	logger         *logrus.Logger
+	FileCache      cache.IFileCache
+	CacheInspector cache.IFileCacheInspector
+	DAL            dal.DAL
+
+	// PeerPurger forwards the purges to the other nodes. It's nil if the node is not in a cluster.
+	PeerPurger IPeerPurger
+
+	// apiKey is the key that the admin requests must have in the 'api-key' header
+	apiKey string
+}
+
+// New generates new AdminController
+func New(ctx context.Context, dal dal.DAL, cache cache.IFileCache, cacheInspector cache.IFileCacheInspector, peerPurger IPeerPurger, apiKey string) (controller.IAdminController, error) {
+	logger, err := log.Of(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return AdminController{
+		DAL:            dal,
+		FileCache:      cache,
+		CacheInspector: cacheInspector,
+		PeerPurger:     peerPurger,
+		logger:         logger,
+		apiKey:         apiKey,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package admincont
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	core "github.com/devingen/api-core"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal/daltest"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestController(t *testing.T) (controller.IAdminController, *filemapcache.FileMapCache) {
+	ctx := log.WithLogger(context.Background(), logrus.New())
+
+	fileCache, err := filemapcache.New(ctx, config.Cache{ResetInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileCache.SaveFile("a1b2c3/0.0.1/index.html", &s3.GetObjectOutput{}, []byte("index"))
+	fileCache.SaveFile("a1b2c3/0.0.2/index.html", &s3.GetObjectOutput{}, []byte("new-index"))
+	fileCache.SaveFile("d4e5f6/0.0.1/index.html", &s3.GetObjectOutput{}, []byte("other"))
+
+	bucket := &model.Bucket{Domain: aws.String("acme"), Folder: aws.String("a1b2c3")}
+	adminController, err := New(ctx, &daltest.DAL{Bucket: bucket}, fileCache, fileCache, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adminController, fileCache
+}
+
+func purgeRequest(apiKey, body string) core.Request {
+	return core.Request{
+		HTTPMethod: http.MethodPost,
+		Headers:    map[string]string{"api-key": apiKey},
+		Body:       body,
+	}
+}
+
+func TestPurgeRequiresAPIKey(t *testing.T) {
+	adminController, _ := newTestController(t)
+
+	_, _, err := adminController.Purge(context.Background(), purgeRequest("wrong", `{"domain":"acme"}`))
+	assert.Equal(t, http.StatusUnauthorized, err.(*core.DVNError).StatusCode, "incorrect status")
+}
+
+func TestPurgesBucketVersion(t *testing.T) {
+	adminController, fileCache := newTestController(t)
+
+	result, status, err := adminController.Purge(context.Background(), purgeRequest("secret", `{"domain":"acme","version":"0.0.1"}`))
+	assert.Nil(t, err, "purge must succeed")
+	assert.Equal(t, http.StatusOK, status, "incorrect status")
+	assert.Equal(t, cache.PurgeResult{Entries: 1, Bytes: 5}, result, "incorrect purge result")
+
+	_, _, hasPurged := fileCache.GetFile("a1b2c3/0.0.1/index.html")
+	_, _, hasOtherVersion := fileCache.GetFile("a1b2c3/0.0.2/index.html")
+	assert.False(t, hasPurged, "file of the version must be purged")
+	assert.True(t, hasOtherVersion, "file of the other version must be kept")
+}
+
+func TestPurgesPrefix(t *testing.T) {
+	adminController, _ := newTestController(t)
+
+	result, _, err := adminController.Purge(context.Background(), purgeRequest("secret", `{"prefix":"a1b2c3/"}`))
+	assert.Nil(t, err, "purge must succeed")
+	assert.Equal(t, cache.PurgeResult{Entries: 2, Bytes: 14}, result, "incorrect purge result")
+}
+
+func TestRejectsVersionWithoutDomain(t *testing.T) {
+	adminController, fileCache := newTestController(t)
+
+	for _, body := range []string{
+		`{"version":"0.0.1"}`,
+		`{"prefix":"a1b2c3/","version":"0.0.1"}`,
+		`{"path":"a1b2c3/0.0.2/index.html","version":"0.0.1"}`,
+	} {
+		_, _, err := adminController.Purge(context.Background(), purgeRequest("secret", body))
+		assert.Equal(t, http.StatusBadRequest, err.(*core.DVNError).StatusCode, "incorrect status for "+body)
+	}
+	_, _, hasFile := fileCache.GetFile("a1b2c3/0.0.2/index.html")
+	assert.True(t, hasFile, "files must not be purged")
+}
+
+func TestGetsCacheStats(t *testing.T) {
+	adminController, fileCache := newTestController(t)
+	fileCache.GetFile("a1b2c3/0.0.1/index.html")
+	fileCache.GetFile("a1b2c3/0.0.1/missing.html")
+
+	req := core.Request{
+		HTTPMethod:            http.MethodGet,
+		Headers:               map[string]string{"api-key": "secret"},
+		QueryStringParameters: map[string]string{"prefix": "a1b2c3/0.0.2/"},
+	}
+	result, _, err := adminController.GetCacheStats(context.Background(), req)
+	assert.Nil(t, err, "getting stats must succeed")
+
+	response := result.(GetCacheStatsResponse)
+	assert.Equal(t, 3, response.Stats.Entries, "incorrect entry count")
+	assert.Equal(t, int64(19), response.Stats.Bytes, "incorrect bytes")
+	assert.Equal(t, int64(1), response.Stats.Hits, "incorrect hits")
+	assert.Equal(t, int64(1), response.Stats.Misses, "incorrect misses")
+	assert.Equal(t, 2, response.Stats.Buckets["a1b2c3"].Entries, "incorrect bucket entry count")
+	assert.Equal(t, int64(14), response.Stats.Buckets["a1b2c3"].Bytes, "incorrect bucket bytes")
+
+	assert.Len(t, response.Entries, 1, "entries must be filtered by prefix")
+	assert.Equal(t, "a1b2c3/0.0.2/index.html", response.Entries[0].Path, "incorrect entry")
+}
+
+// testPeerPurger records the forwarded purges
+type testPeerPurger struct {
+	paths []string
+	err   error
+}
+
+func (pp *testPeerPurger) PurgePeers(ctx context.Context, path string, isPrefix bool) error {
+	pp.paths = append(pp.paths, path)
+	return pp.err
+}
+
+func TestForwardsPurgeToPeers(t *testing.T) {
+	_, fileCache := newTestController(t)
+	peerPurger := &testPeerPurger{}
+	adminController, err := New(log.WithLogger(context.Background(), logrus.New()), &daltest.DAL{}, fileCache, fileCache, peerPurger, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, status, err := adminController.Purge(context.Background(), purgeRequest("secret", `{"prefix":"a1b2c3/"}`))
+	assert.Nil(t, err, "purge must succeed")
+	assert.Equal(t, http.StatusOK, status, "incorrect status")
+	assert.Equal(t, []string{"a1b2c3/"}, peerPurger.paths, "purge must be forwarded")
+
+	peerPurger.err = errors.New("purging-peers-failed")
+	_, _, err = adminController.Purge(context.Background(), purgeRequest("secret", `{"prefix":"a1b2c3/"}`))
+	assert.Equal(t, http.StatusBadGateway, err.(*core.DVNError).StatusCode, "failed forward must be reported")
+}
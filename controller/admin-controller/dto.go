@@ -0,0 +1,25 @@
+package admincont
+
+import "github.com/devingen/sepet-cdn/cache"
+
+// PurgeRequest defines the files to be removed from the cache. Only one of the path, prefix
+// and domain must be given.
+type PurgeRequest struct {
+	// Path is the exact path of the file in the file server. E.g. 'a1b2c3/0.0.1/index.html'
+	Path *string `json:"path,omitempty"`
+
+	// Prefix is the beginning of the paths of the files in the file server. E.g. 'a1b2c3/0.0.1/static/'
+	Prefix *string `json:"prefix,omitempty"`
+
+	// Domain is the domain of the bucket to remove all the files of. E.g. 'acme'
+	Domain *string `json:"domain,omitempty"`
+
+	// Version limits the removed files of the bucket to the given version. It can be given only with the domain.
+	Version *string `json:"version,omitempty"`
+}
+
+// GetCacheStatsResponse contains the cache statistics and the entries if they're requested
+type GetCacheStatsResponse struct {
+	Stats   cache.Stats       `json:"stats"`
+	Entries []cache.EntryInfo `json:"entries,omitempty"`
+}
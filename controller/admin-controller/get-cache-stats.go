@@ -0,0 +1,29 @@
+package admincont
+
+import (
+	"context"
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/controller"
+	"net/http"
+)
+
+// GetCacheStats returns the statistics of the cache. The cached entries starting with the prefix are
+// listed as well if the 'prefix' query parameter is given. Use an empty prefix to list all the entries.
+func (ac AdminController) GetCacheStats(ctx context.Context, req core.Request) (interface{}, int, error) {
+	if err := controller.AssertAPIKey(req, ac.apiKey); err != nil {
+		return nil, 0, err
+	}
+
+	if req.HTTPMethod != http.MethodGet {
+		return nil, 0, core.NewError(http.StatusMethodNotAllowed, "method-not-allowed")
+	}
+
+	response := GetCacheStatsResponse{
+		Stats: ac.CacheInspector.Stats(),
+	}
+
+	if prefix, hasPrefix := req.QueryStringParameters["prefix"]; hasPrefix {
+		response.Entries = ac.CacheInspector.Entries(prefix)
+	}
+	return response, http.StatusOK, nil
+}
@@ -0,0 +1,77 @@
+package admincont
+
+import (
+	"context"
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/controller"
+	"net/http"
+)
+
+// Purge removes the files from the cache and returns the number of the entries and the bytes removed. The purge
+// is forwarded to the other nodes of the cluster and it fails if any of them fails, it can be retried safely.
+func (ac AdminController) Purge(ctx context.Context, req core.Request) (interface{}, int, error) {
+	if err := controller.AssertAPIKey(req, ac.apiKey); err != nil {
+		return nil, 0, err
+	}
+
+	if req.HTTPMethod != http.MethodPost {
+		return nil, 0, core.NewError(http.StatusMethodNotAllowed, "method-not-allowed")
+	}
+
+	var body PurgeRequest
+	if err := req.AssertBody(&body); err != nil {
+		return nil, 0, err
+	}
+
+	path, isPrefix, err := ac.getPurgePath(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := ac.FileCache.Purge(path, isPrefix)
+	if ac.PeerPurger != nil {
+		if err := ac.PeerPurger.PurgePeers(ctx, path, isPrefix); err != nil {
+			return nil, 0, core.NewError(http.StatusBadGateway, err.Error())
+		}
+	}
+	return result, http.StatusOK, nil
+}
+
+// getPurgePath returns the path or the path prefix of the files to be purged
+func (ac AdminController) getPurgePath(body PurgeRequest) (string, bool, error) {
+	givenFieldCount := 0
+	for _, field := range []*string{body.Path, body.Prefix, body.Domain} {
+		if field != nil {
+			givenFieldCount++
+		}
+	}
+	if givenFieldCount != 1 {
+		return "", false, core.NewError(http.StatusBadRequest, "one-of-path-prefix-domain-required")
+	}
+	if body.Version != nil && body.Domain == nil {
+		// the version would be ignored and more files than requested would be purged
+		return "", false, core.NewError(http.StatusBadRequest, "version-requires-domain")
+	}
+
+	if body.Path != nil {
+		return *body.Path, false, nil
+	}
+
+	if body.Prefix != nil {
+		if *body.Prefix == "" {
+			return "", false, core.NewError(http.StatusBadRequest, "prefix-empty")
+		}
+		return *body.Prefix, true, nil
+	}
+
+	bucket := ac.DAL.GetBucket(*body.Domain)
+	if bucket == nil {
+		return "", false, core.NewError(http.StatusNotFound, "bucket-not-found")
+	}
+
+	prefix := core.StringValue(bucket.Folder) + "/"
+	if body.Version != nil {
+		prefix += *body.Version + "/"
+	}
+	return prefix, true, nil
+}
@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"crypto/subtle"
+	core "github.com/devingen/api-core"
+	"net/http"
+)
+
+// AssertAPIKey returns an error if the request doesn't have the API key in the 'api-key' header. All the requests
+// are rejected if the API key is empty.
+func AssertAPIKey(req core.Request, apiKey string) error {
+	reqAPIKey, _ := req.GetHeader("api-key")
+	if apiKey == "" || subtle.ConstantTimeCompare([]byte(reqAPIKey), []byte(apiKey)) != 1 {
+		return core.NewError(http.StatusUnauthorized, "unauthorized")
+	}
+	return nil
+}
@@ -1,10 +1,34 @@
 package controller
 
 import (
+	"context"
+	core "github.com/devingen/api-core"
 	"net/http"
 )
 
 // IServiceController defines the functionality of the service controller
 type IServiceController interface {
 	GetFile(w http.ResponseWriter, r *http.Request)
+
+	// GetPeerFile serves the files owned by this node to the other CDN nodes in the cluster
+	GetPeerFile(w http.ResponseWriter, r *http.Request)
+
+	// PurgePeerFiles removes the files from the cache for the purges forwarded by the other CDN nodes
+	PurgePeerFiles(w http.ResponseWriter, r *http.Request)
+}
+
+// IAdminController defines the functionality of the admin controller
+type IAdminController interface {
+	Purge(ctx context.Context, req core.Request) (interface{}, int, error)
+	GetCacheStats(ctx context.Context, req core.Request) (interface{}, int, error)
+}
+
+// IHealthController defines the functionality of the health controller
+type IHealthController interface {
+	GetHealth(ctx context.Context, req core.Request) (interface{}, int, error)
+}
+
+// IWebhookController defines the functionality of the webhook controller that's called by the Sepet API
+type IWebhookController interface {
+	UpdateBucket(ctx context.Context, req core.Request) (interface{}, int, error)
 }
@@ -0,0 +1,17 @@
+package healthcont
+
+const (
+	// StatusOK is the status of the node that serves the files with the up-to-date buckets
+	StatusOK = "ok"
+
+	// StatusDegraded is the status of the node that serves the files with the last known buckets
+	StatusDegraded = "degraded"
+)
+
+// GetHealthResponse contains the status of the node
+type GetHealthResponse struct {
+	Status string `json:"status"`
+
+	// IsBucketListStale is true if the buckets couldn't be synced with the Sepet API since the startup
+	IsBucketListStale bool `json:"isBucketListStale"`
+}
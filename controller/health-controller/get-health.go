@@ -0,0 +1,24 @@
+package healthcont
+
+import (
+	"context"
+	core "github.com/devingen/api-core"
+	"net/http"
+)
+
+// GetHealth returns the status of the node. The node responds with 200 even if it's degraded since it can
+// still serve the files and all the nodes would be degraded together while the Sepet API is down.
+func (hc HealthController) GetHealth(ctx context.Context, req core.Request) (interface{}, int, error) {
+	if req.HTTPMethod != http.MethodGet {
+		return nil, 0, core.NewError(http.StatusMethodNotAllowed, "method-not-allowed")
+	}
+
+	response := GetHealthResponse{
+		Status:            StatusOK,
+		IsBucketListStale: hc.DAL.IsStale(),
+	}
+	if response.IsBucketListStale {
+		response.Status = StatusDegraded
+	}
+	return response, http.StatusOK, nil
+}
@@ -0,0 +1,28 @@
+package healthcont
+
+import (
+	"context"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthController implements IHealthController interface
+type HealthController struct {
+	logger *logrus.Logger
+	DAL    dal.DAL
+}
+
+// New generates new HealthController
+func New(ctx context.Context, dal dal.DAL) (controller.IHealthController, error) {
+	logger, err := log.Of(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return HealthController{
+		DAL:    dal,
+		logger: logger,
+	}, nil
+}
@@ -0,0 +1,35 @@
+package healthcont
+
+import (
+	"context"
+	core "github.com/devingen/api-core"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/dal/daltest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestGetsHealth(t *testing.T) {
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	req := core.Request{HTTPMethod: http.MethodGet}
+
+	healthController, err := New(ctx, &daltest.DAL{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, status, err := healthController.GetHealth(ctx, req)
+	assert.Nil(t, err, "getting health must succeed")
+	assert.Equal(t, http.StatusOK, status, "incorrect status")
+	assert.Equal(t, GetHealthResponse{Status: StatusOK}, result, "incorrect health")
+
+	healthController, err = New(ctx, &daltest.DAL{Stale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, status, err = healthController.GetHealth(ctx, req)
+	assert.Nil(t, err, "getting health must succeed")
+	assert.Equal(t, http.StatusOK, status, "degraded node must still be healthy")
+	assert.Equal(t, GetHealthResponse{Status: StatusDegraded, IsBucketListStale: true}, result, "incorrect health")
+}
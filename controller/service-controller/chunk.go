@@ -0,0 +1,300 @@
+package srvcont
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/sepet-cdn/cache"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errChunkReaderClosed used when the chunk reader is read after it's closed
+var errChunkReaderClosed = errors.New("chunk-reader-closed")
+
+// openFileChunks returns the requested range of the large file to be read chunk by chunk. If cachedOnly is true,
+// the range is returned only if its first chunk is cached. Returns nil if the range can't be served from the
+// chunks like the multiple ranges, the suffix ranges or the ranges with If-Range conditions that don't match.
+func (sc ServiceController) openFileChunks(ctx context.Context, filePath string, fileRange *fs.FileRange, cachedOnly bool) (*loadedFile, error) {
+	if sc.chunkBytes <= 0 || fileRange == nil {
+		return nil, nil
+	}
+
+	start, end, ok := parseByteRange(fileRange.Range)
+	if !ok {
+		return nil, nil
+	}
+
+	reader := &chunkReader{
+		ctx:         ctx,
+		fileCache:   sc.FileCache,
+		fileService: sc.FileService,
+		filePath:    filePath,
+		chunkBytes:  sc.chunkBytes,
+		offset:      start,
+	}
+
+	index := start / sc.chunkBytes
+	reader.lastCachedIndex = math.MaxInt64
+	if sc.chunkWindow > 0 {
+		reader.lastCachedIndex = index + sc.chunkWindow - 1
+	}
+	chunk, meta, fromCache, err := reader.loadChunk(index, cachedOnly)
+	if err != nil || chunk == nil {
+		return nil, err
+	}
+
+	size, ok := parseContentRangeSize(aws.StringValue(meta.ContentRange))
+	if !ok || !matchesIfRange(fileRange.IfRange, meta) {
+		return nil, nil
+	}
+	if start >= size {
+		return nil, fs.ErrorRangeNotSatisfiable
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+
+	reader.eTag = aws.StringValue(meta.ETag)
+	reader.end = end
+	reader.setChunk(index, chunk)
+
+	rangeMeta := *meta
+	rangeMeta.Body = nil
+	rangeMeta.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	rangeMeta.ContentLength = aws.Int64(end - start + 1)
+	return &loadedFile{body: reader, meta: &rangeMeta, fromCache: fromCache}, nil
+}
+
+// chunkReader reads the range of a large file chunk by chunk. The chunks are read from the cache or fetched
+// from the file service and saved into the cache.
+type chunkReader struct {
+	ctx         context.Context
+	fileCache   cache.IFileCache
+	fileService fs.IFileService
+	filePath    string
+	chunkBytes  int64
+
+	// eTag is the ETag of the first chunk, the other chunks must belong to the same version of the file
+	eTag string
+
+	// offset is the next byte to read and end is the last byte of the range
+	offset int64
+	end    int64
+
+	// lastCachedIndex is the index of the last chunk that's saved into the cache. The rest of the range is
+	// streamed with a single request once the reader passes it.
+	lastCachedIndex int64
+
+	// current is the unread part of the current chunk
+	current []byte
+
+	// stream is the body of the rest of the range past the cached chunks. It's set under the lock to be closed
+	// by Close while it's being read.
+	stream io.ReadCloser
+	lock   sync.Mutex
+
+	// closed is set to 1 atomically when the reader is closed
+	closed int32
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&cr.closed) == 1 {
+		return 0, errChunkReaderClosed
+	}
+	if cr.offset > cr.end {
+		return 0, io.EOF
+	}
+	if cr.stream != nil {
+		return cr.readStream(p)
+	}
+
+	if len(cr.current) == 0 {
+		index := cr.offset / cr.chunkBytes
+		chunk, _, _, err := cr.loadChunk(index, index > cr.lastCachedIndex)
+		if err != nil {
+			return 0, err
+		}
+		if chunk == nil {
+			// the chunk is past the cached window and it's not cached by the other requests
+			if err := cr.openStream(); err != nil {
+				return 0, err
+			}
+			return cr.readStream(p)
+		}
+		cr.setChunk(index, chunk)
+		if len(cr.current) == 0 {
+			// the file is shorter than its first chunk said
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+
+	n := copy(p, cr.current)
+	cr.current = cr.current[n:]
+	cr.offset += int64(n)
+	return n, nil
+}
+
+// Close stops the reading. The chunk that's being fetched is still saved into the cache.
+func (cr *chunkReader) Close() error {
+	atomic.StoreInt32(&cr.closed, 1)
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if cr.stream != nil {
+		return cr.stream.Close()
+	}
+	return nil
+}
+
+// openStream gets the rest of the range from the file service in a single request. Returns ErrorFileModified
+// if the file doesn't have the ETag of the chunks anymore.
+func (cr *chunkReader) openStream() error {
+	fileRange := &fs.FileRange{Range: fmt.Sprintf("bytes=%d-%d", cr.offset, cr.end), IfRange: cr.eTag}
+	meta, err := cr.fileService.GetFileStream(cr.ctx, cr.filePath, fileRange)
+	if err != nil {
+		return err
+	}
+	if meta.ContentRange == nil || aws.StringValue(meta.ETag) != cr.eTag {
+		// the whole file is returned since the If-Range condition failed
+		fs.CloseBody(meta)
+		cr.fileCache.Purge(cr.filePath, false)
+		return fs.ErrorFileModified
+	}
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if atomic.LoadInt32(&cr.closed) == 1 {
+		meta.Body.Close()
+		return errChunkReaderClosed
+	}
+	cr.stream = meta.Body
+	return nil
+}
+
+// readStream reads the rest of the range from the stream
+func (cr *chunkReader) readStream(p []byte) (int, error) {
+	if remaining := cr.end - cr.offset + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := cr.stream.Read(p)
+	cr.offset += int64(n)
+	if err == io.EOF && cr.offset <= cr.end {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// setChunk sets the unread part of the chunk at the index by the offset and the end of the range
+func (cr *chunkReader) setChunk(index int64, chunk []byte) {
+	chunkStart := index * cr.chunkBytes
+	from := cr.offset - chunkStart
+	to := cr.end - chunkStart + 1
+	if to > int64(len(chunk)) {
+		to = int64(len(chunk))
+	}
+
+	if from >= to {
+		cr.current = nil
+		return
+	}
+	cr.current = chunk[from:to]
+}
+
+// loadChunk returns the chunk from the cache or fetches it from the file service and saves it into the cache
+// if it's in the cached window of the range. The cached chunks of the other versions of the file are ignored
+// once the ETag is known. The returned bool is true if the chunk is served from the cache.
+func (cr *chunkReader) loadChunk(index int64, cachedOnly bool) ([]byte, *s3.GetObjectOutput, bool, error) {
+	chunk, meta, hasCache := cr.fileCache.GetFileChunk(cr.filePath, index)
+	if hasCache && (cr.eTag == "" || aws.StringValue(meta.ETag) == cr.eTag) {
+		return chunk, meta, true, nil
+	}
+	if cachedOnly {
+		return nil, nil, false, nil
+	}
+
+	start := index * cr.chunkBytes
+	meta, chunk, err := cr.fileService.GetFilePart(cr.ctx, cr.filePath, start, start+cr.chunkBytes-1, cr.eTag)
+	if err == fs.ErrorFileModified {
+		// the cached chunks belong to the old version of the file
+		cr.fileCache.Purge(cr.filePath, false)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if index <= cr.lastCachedIndex {
+		cr.fileCache.SaveFileChunk(cr.filePath, index, meta, chunk)
+	}
+	return chunk, meta, false, nil
+}
+
+// parseByteRange returns the first and the last bytes of the range header like 'bytes=0-1023'. The last byte
+// is -1 for the open ranges like 'bytes=1024-'. Returns false for the multiple ranges and the suffix ranges.
+func parseByteRange(rangeHeader string) (int64, int64, bool) {
+	if !strings.HasPrefix(rangeHeader, "bytes=") || strings.Contains(rangeHeader, ",") {
+		return 0, 0, false
+	}
+
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(rangeHeader, "bytes=")), "-")
+	if len(parts) != 2 || parts[0] == "" {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if parts[1] == "" {
+		return start, -1, true
+	}
+
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// parseContentRangeSize returns the size of the whole file from the content range like 'bytes 0-1023/4096'
+func parseContentRangeSize(contentRange string) (int64, bool) {
+	slashIndex := strings.LastIndexByte(contentRange, '/')
+	if slashIndex < 0 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(contentRange[slashIndex+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// matchesIfRange returns true if the If-Range header is empty or matches the ETag or the last modification
+// date of the file exactly. The weak ETags never match.
+func matchesIfRange(ifRange string, meta *s3.GetObjectOutput) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == aws.StringValue(meta.ETag)
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil || meta.LastModified == nil {
+		return false
+	}
+	return meta.LastModified.Truncate(time.Second).Equal(date)
+}
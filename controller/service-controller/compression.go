@@ -0,0 +1,279 @@
+package srvcont
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go/service/s3"
+	core "github.com/devingen/api-core"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+
+	// brotliLevel is a balance between the compression ratio and the time spent since the files
+	// are compressed while the client is waiting
+	brotliLevel = 5
+)
+
+// precompressedFileExtensions are the extensions of the precompressed siblings of the files by their encodings
+var precompressedFileExtensions = map[string]string{
+	encodingBrotli: ".br",
+	encodingGzip:   ".gz",
+}
+
+// compressibleContentTypes are the content types that are compressed in addition to the text types
+var compressibleContentTypes = map[string]bool{
+	"application/javascript":        true,
+	"application/x-javascript":      true,
+	"application/json":              true,
+	"application/manifest+json":     true,
+	"application/xml":               true,
+	"application/xhtml+xml":         true,
+	"application/rss+xml":           true,
+	"application/atom+xml":          true,
+	"application/wasm":              true,
+	"application/vnd.ms-fontobject": true,
+	"image/svg+xml":                 true,
+	"image/x-icon":                  true,
+	"image/vnd.microsoft.icon":      true,
+	"font/ttf":                      true,
+	"font/otf":                      true,
+	"font/eot":                      true,
+	"application/x-font-ttf":        true,
+	"application/x-font-otf":        true,
+}
+
+// loadPrecompressedFile returns the precompressed sibling of the file with its encoding if the bucket has
+// precompressed files and the client accepts the encoding. The returned file is nil if there is no
+// sibling for the accepted encodings. The siblings are looked up only for the compressible files and the
+// missing siblings are remembered to not look them up on every request.
+func (sc ServiceController) loadPrecompressedFile(ctx context.Context, logger *logrus.Entry, w http.ResponseWriter, r *http.Request, bucket *model.Bucket, filePath string) (*loadedFile, string) {
+	if !core.BoolValue(bucket.IsPrecompressedFilesEnabled) || !isCompressible(getPrecompressedContentType(filePath)) {
+		return nil, ""
+	}
+
+	// the response differs by the accepted encodings even if the sibling doesn't exist
+	addVaryHeader(w, "Accept-Encoding")
+
+	for _, encoding := range getAcceptedEncodings(r.Header.Get("Accept-Encoding")) {
+		siblingPath := filePath + precompressedFileExtensions[encoding]
+		if sc.FileCache.IsFileMissing(siblingPath) {
+			continue
+		}
+
+		file, err := sc.loadFile(ctx, logger, bucket, siblingPath, nil)
+		if err == nil {
+			return file, encoding
+		}
+		if err == fs.ErrorFileNotFound {
+			// the missing siblings of the buckets with caching disabled are remembered as well
+			sc.FileCache.SaveMissingFile(siblingPath)
+		} else {
+			logger.WithFields(logrus.Fields{
+				"file":  siblingPath,
+				"error": err.Error(),
+			}).Warn("loading-precompressed-file-failed")
+		}
+	}
+	return nil, ""
+}
+
+// encodeFile compresses the file content with the encoding that's accepted by the client and returns the encoded
+// content. The content is returned as is if it's not compressed. The encoded contents are kept in the cache next
+// to the file to compress a file only once. The content of the range requests is not compressed since the range
+// is the range of the uncompressed content.
+func (sc ServiceController) encodeFile(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, bucket *model.Bucket, cachePath, name string, content []byte, meta *s3.GetObjectOutput) []byte {
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = getContentType(name, content)
+	}
+
+	encoding := sc.negotiateFileEncoding(w, r, contentType, int64(len(content)), meta)
+	if encoding == "" || r.Header.Get("Range") != "" {
+		return content
+	}
+
+	isCacheEnabled := core.BoolValue(bucket.IsCacheEnabled)
+	encodedContent, hasVariant := []byte(nil), false
+	if isCacheEnabled {
+		encodedContent, hasVariant = sc.FileCache.GetFileVariant(cachePath, meta, encoding)
+	}
+	if !hasVariant {
+		var err error
+		encodedContent, err = encode(content, encoding)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"encoding": encoding,
+				"error":    err.Error(),
+			}).Warn("compressing-file-failed")
+			return content
+		}
+		if isCacheEnabled {
+			sc.FileCache.SaveFileVariant(cachePath, meta, encoding, encodedContent)
+		}
+	}
+
+	// the already compressed contents may get larger
+	if len(encodedContent) >= len(content) {
+		return content
+	}
+
+	setEncodingHeaders(w, contentType, encoding)
+	return encodedContent
+}
+
+// negotiateFileEncoding returns the encoding to compress the file for the client. Returns an empty string if the
+// file shouldn't be compressed. The Vary header is added if the file is compressible.
+func (sc ServiceController) negotiateFileEncoding(w http.ResponseWriter, r *http.Request, contentType string, size int64, meta *s3.GetObjectOutput) string {
+	if !sc.compression.Enabled || size < int64(sc.compression.MinBytes) || core.StringValue(meta.ContentEncoding) != "" {
+		return ""
+	}
+	if !isCompressible(contentType) {
+		return ""
+	}
+
+	// the response differs by the accepted encodings even if the file is not compressed for this client
+	addVaryHeader(w, "Accept-Encoding")
+
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"))
+}
+
+// setEncodingHeaders sets the headers of the encoded content. The content type is set explicitly since
+// it can't be detected from the encoded content by http.ServeContent.
+func setEncodingHeaders(w http.ResponseWriter, contentType, encoding string) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Encoding", encoding)
+}
+
+// addVaryHeader adds the header name to the Vary header if it's not listed yet
+func addVaryHeader(w http.ResponseWriter, headerName string) {
+	for _, value := range w.Header()["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), headerName) {
+				return
+			}
+		}
+	}
+	w.Header().Add("Vary", headerName)
+}
+
+// getContentType returns the content type in the same way http.ServeContent does
+func getContentType(name string, content []byte) string {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	return contentType
+}
+
+// getPrecompressedContentType returns the content type of the original file of a precompressed file. The type
+// can be detected only by the extension since the content is encoded.
+func getPrecompressedContentType(name string) string {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
+
+func isCompressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasPrefix(mediaType, "text/") || compressibleContentTypes[mediaType] {
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// negotiateEncoding returns the encoding to compress the content for the given Accept-Encoding header.
+// Returns an empty string if none of the supported encodings is accepted.
+func negotiateEncoding(acceptEncoding string) string {
+	encodings := getAcceptedEncodings(acceptEncoding)
+	if len(encodings) == 0 {
+		return ""
+	}
+	return encodings[0]
+}
+
+// getAcceptedEncodings returns the supported encodings that are accepted by the given Accept-Encoding header
+// in the order of preference. Brotli is preferred over gzip when both are accepted with the same quality.
+func getAcceptedEncodings(acceptEncoding string) []string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = parsed
+				}
+			}
+		}
+		qualities[coding] = quality
+	}
+
+	brotliQuality := getEncodingQuality(qualities, encodingBrotli)
+	gzipQuality := getEncodingQuality(qualities, encodingGzip)
+
+	encodings := make([]string, 0, 2)
+	if brotliQuality > 0 && brotliQuality >= gzipQuality {
+		encodings = append(encodings, encodingBrotli)
+	}
+	if gzipQuality > 0 {
+		encodings = append(encodings, encodingGzip)
+	}
+	if brotliQuality > 0 && brotliQuality < gzipQuality {
+		encodings = append(encodings, encodingBrotli)
+	}
+	return encodings
+}
+
+// getEncodingQuality returns the quality of the encoding. The wildcard quality is used if the encoding
+// is not listed.
+func getEncodingQuality(qualities map[string]float64, encoding string) float64 {
+	if quality, exists := qualities[encoding]; exists {
+		return quality
+	}
+	return qualities["*"]
+}
+
+func encode(content []byte, encoding string) ([]byte, error) {
+	var buff bytes.Buffer
+	writer := newEncoder(&buff, encoding)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// newEncoder returns the writer that compresses the content with the encoding. The writer must be closed
+// to flush the compressed content.
+func newEncoder(w io.Writer, encoding string) io.WriteCloser {
+	if encoding == encodingBrotli {
+		return brotli.NewWriterLevel(w, brotliLevel)
+	}
+	return gzip.NewWriter(w)
+}
@@ -0,0 +1,105 @@
+package srvcont
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	peerfs "github.com/devingen/sepet-cdn/file-service/peer-file-service"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// GetPeerFile serves the files owned by this node to the other nodes of the cluster. The file is served from the
+// cache or fetched from the file service and saved into the cache. The purges are forwarded to all the nodes, so
+// the cached file is served even if the peer doesn't have it. The files that are too large to cache are not
+// served to let the peers stream them from the file service.
+func (sc ServiceController) GetPeerFile(w http.ResponseWriter, r *http.Request) {
+	ctx := peerfs.WithPeerRequest(r.Context())
+
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		http.Error(w, "path-is-missing", http.StatusBadRequest)
+		return
+	}
+
+	logger := sc.logger.WithFields(logrus.Fields{
+		"file": filePath,
+	})
+
+	fileContent, fileMeta, fromCache := sc.FileCache.GetFile(filePath)
+	if !fromCache {
+		if sc.FileCache.IsFileMissing(filePath) {
+			http.Error(w, "file-not-found", http.StatusNotFound)
+			return
+		}
+		if sc.FileCache.IsFileTooLarge(filePath) {
+			http.Error(w, "file-too-large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		staleContent, staleMeta, _, _ := sc.FileCache.GetStaleFile(filePath)
+
+		var err error
+		fileMeta, fileContent, err = sc.fetchFile(ctx, filePath, staleContent, staleMeta)
+		switch err {
+		case nil:
+		case fs.ErrorFileNotFound:
+			http.Error(w, "file-not-found", http.StatusNotFound)
+			return
+		case fs.ErrorFileTooLarge:
+			fs.CloseBody(fileMeta)
+			http.Error(w, "file-too-large", http.StatusRequestEntityTooLarge)
+			return
+		default:
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Warn("fetching-file-for-peer-failed")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && ifNoneMatch == aws.StringValue(fileMeta.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	encodedMeta, err := peerfs.EncodeMeta(fileMeta)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"from-cache": fromCache,
+	}).Debug("served-file-to-peer")
+
+	w.Header().Set(peerfs.MetaHeader, encodedMeta)
+	w.Header().Set("Content-Length", strconv.Itoa(len(fileContent)))
+	w.Write(fileContent)
+}
+
+// PurgePeerFiles removes the files from the cache for the purges forwarded by the other nodes of the cluster. The
+// file path is given in the 'path' query parameter and it's used as a prefix if the 'prefix' parameter is true.
+func (sc ServiceController) PurgePeerFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method-not-allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	isPrefix := r.URL.Query().Get("prefix") == "true"
+	if path == "" {
+		http.Error(w, "path-is-missing", http.StatusBadRequest)
+		return
+	}
+
+	result := sc.FileCache.Purge(path, isPrefix)
+	sc.logger.WithFields(logrus.Fields{
+		"path":          path,
+		"isPrefix":      isPrefix,
+		"purgedEntries": result.Entries,
+		"purgedBytes":   result.Bytes,
+	}).Info("purged-files-for-peer")
+	w.WriteHeader(http.StatusOK)
+}
@@ -3,15 +3,19 @@ package srvcont
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	core "github.com/devingen/api-core"
 	"github.com/devingen/api-core/log"
 	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/config"
 	"github.com/devingen/sepet-cdn/controller"
 	"github.com/devingen/sepet-cdn/dal"
 	fs "github.com/devingen/sepet-cdn/file-service"
 	"github.com/devingen/sepet-cdn/model"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
@@ -24,29 +28,56 @@ type ServiceController struct {
 	FileCache   cache.IFileCache
 	FileService fs.IFileService
 	DAL         dal.DAL
+
+	// staleWhileRevalidate is how long an expired file is served while it's being refreshed
+	staleWhileRevalidate time.Duration
+
+	// staleIfError is how long an expired file is served when the file service fails
+	staleIfError time.Duration
+
+	// chunkBytes is the chunk size of the large files that are cached in chunks. Zero disables it.
+	chunkBytes int64
+
+	// chunkWindow is the number of chunks cached for a range request. Zero means no limit.
+	chunkWindow int64
+
+	// compression is the configuration of compressing the text based files
+	compression config.Compression
 }
 
 // New generates new ServiceController
-func New(ctx context.Context, dal dal.DAL, cache cache.IFileCache, fileService fs.IFileService) (controller.IServiceController, error) {
+func New(ctx context.Context, dal dal.DAL, cache cache.IFileCache, fileService fs.IFileService, cacheConfig config.Cache, compressionConfig config.Compression) (controller.IServiceController, error) {
 	logger, err := log.Of(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	return ServiceController{
-		DAL:         dal,
-		FileCache:   cache,
-		FileService: fileService,
-		logger:      logger,
+		DAL:                  dal,
+		FileCache:            cache,
+		FileService:          fileService,
+		logger:               logger,
+		staleWhileRevalidate: cacheConfig.StaleWhileRevalidate,
+		staleIfError:         cacheConfig.StaleIfError,
+		chunkBytes:           cacheConfig.ChunkBytes,
+		chunkWindow:          cacheConfig.ChunkWindow,
+		compression:          compressionConfig,
 	}, nil
 }
 
+// GetFile serves the file of the bucket resolved by the host. The file service requests made for the file are
+// canceled when the client disconnects.
 func (sc ServiceController) GetFile(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-
-	bucketDomain := GetBucketDomainNameFromHost(r.Host)
-	bucket := sc.DAL.GetBucket(bucketDomain)
-	if bucket == nil {
+	ctx := r.Context()
+
+	bucket, err := sc.DAL.GetBucketByHost(r.Host)
+	switch err {
+	case nil:
+	case dal.ErrorHostNotServed:
+		// the host may be pointing to the CDN by mistake or to serve the buckets under a foreign domain
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+		return
+	default:
 		http.Error(w, "bucket-not-found", http.StatusNotFound)
 		return
 	}
@@ -66,80 +97,223 @@ func (sc ServiceController) GetFile(w http.ResponseWriter, r *http.Request) {
 		"file":    filePath,
 	})
 
-	if core.BoolValue(bucket.IsCacheEnabled) {
-		fileContent, fileMeta, hasCache := sc.FileCache.GetFile(filePath)
-		if hasCache {
-			logElapsedTime(logger, startTime, true, fileMeta.ContentLength)
+	// try to get the precompressed file, then the file
+	servedFilePath := filePath
+	file, encoding := sc.loadPrecompressedFile(ctx, logger, w, r, bucket, filePath)
+	if file == nil {
+		file, err = sc.loadFile(ctx, logger, bucket, filePath, getFileRange(r))
+	}
+	if err == fs.ErrorFileNotFound {
+		logger.WithFields(logrus.Fields{
+			"file": filePath,
+		}).Debug("file-not-found")
+
+		// try to get the error file
+		servedFilePath = errorFilePath
+		file, err = sc.loadFile(ctx, logger, bucket, errorFilePath, nil)
+		if err == fs.ErrorFileNotFound {
+			logger.WithFields(logrus.Fields{
+				"file": errorFilePath,
+			}).Debug("error-file-not-found")
 
-			setCorsHeadersForOrigin(w, r.Header.Get("Origin"), bucket)
-			setResponseHeaders(w, bucket)
-			http.ServeContent(w, r, filePath, pickLastModified(bucket, fileMeta), bytes.NewReader(fileContent))
+			http.Error(w, "file-not-found", http.StatusNotFound)
 			return
 		}
 	}
-
-	// try to get the file
-	fileMeta, fileContent, err := sc.FileService.GetFile(ctx, filePath)
-	if err != nil {
-		if err == fs.ErrorFileNotFound {
-			logger.WithFields(logrus.Fields{
-				"file": filePath,
-			}).Debug("file-not-found")
-
-			// try to get the error file from cache
-			if core.BoolValue(bucket.IsCacheEnabled) {
-				fileContent, fileMeta, hasCache := sc.FileCache.GetFile(errorFilePath)
-				if hasCache {
-					logElapsedTime(logger, startTime, true, fileMeta.ContentLength)
-
-					setCorsHeadersForOrigin(w, r.Header.Get("Origin"), bucket)
-					setResponseHeaders(w, bucket)
-					http.ServeContent(w, r, filePath, pickLastModified(bucket, fileMeta), bytes.NewReader(fileContent))
-					return
-				}
-			}
-
-			// try to get the error file from file server
-			fileMeta, fileContent, err = sc.FileService.GetFile(ctx, errorFilePath)
-			if err != nil {
-				if err == fs.ErrorFileNotFound {
-					logger.WithFields(logrus.Fields{
-						"file": errorFilePath,
-					}).Debug("error-file-not-found")
-
-					http.Error(w, "file-not-found", http.StatusNotFound)
-					return
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			// save the error file into cache
-			sc.FileCache.SaveFile(errorFilePath, fileMeta, fileContent)
+	if err == fs.ErrorRangeNotSatisfiable {
+		if size, ok := sc.getFileSize(ctx, filePath); ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
 		}
-
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	} else {
-		// save the file into cache
-		sc.FileCache.SaveFile(filePath, fileMeta, fileContent)
 	}
 
-	logElapsedTime(logger, startTime, false, fileMeta.ContentLength)
+	if file.body != nil {
+		defer file.body.Close()
+	}
+
+	logElapsedTime(logger, startTime, file.fromCache, file.meta.ContentLength)
 
 	setCorsHeadersForOrigin(w, r.Header.Get("Origin"), bucket)
 	setResponseHeaders(w, bucket)
-	http.ServeContent(w, r, filePath, pickLastModified(bucket, fileMeta), bytes.NewReader(fileContent))
+	if file.body != nil {
+		sc.serveFileStream(logger, w, r, bucket, filePath, encoding, file)
+		return
+	}
+
+	fileContent := file.content
+	if encoding != "" {
+		setEncodingHeaders(w, getPrecompressedContentType(filePath), encoding)
+	} else {
+		fileContent = sc.encodeFile(logger, w, r, bucket, servedFilePath, filePath, fileContent, file.meta)
+	}
+	http.ServeContent(w, r, filePath, pickLastModified(bucket, file.meta), bytes.NewReader(fileContent))
+}
+
+// loadedFile is the file returned by loadFile. Either the content or the body is set. The body is streamed
+// from the file service and must be closed by the caller.
+type loadedFile struct {
+	content   []byte
+	body      io.ReadCloser
+	meta      *s3.GetObjectOutput
+	fromCache bool
+}
+
+// loadFile returns the file from the cache if it's not expired. Otherwise, gets the file from the file service
+// and saves it into the cache. Expired files are served while they're being refreshed in the background or
+// when the file service fails. The files that are too large to cache and the files of the buckets with
+// caching disabled are streamed from the file service. Only the given range of the streamed files is requested
+// from the file service if the range is not nil. The range of the buffered files is served by http.ServeContent.
+func (sc ServiceController) loadFile(ctx context.Context, logger *logrus.Entry, bucket *model.Bucket, filePath string, fileRange *fs.FileRange) (*loadedFile, error) {
+	if !core.BoolValue(bucket.IsCacheEnabled) {
+		return sc.openFileStream(ctx, filePath, fileRange)
+	}
+
+	fileContent, fileMeta, hasCache := sc.FileCache.GetFile(filePath)
+	if hasCache {
+		return &loadedFile{content: fileContent, meta: fileMeta, fromCache: true}, nil
+	}
+
+	if sc.FileCache.IsFileMissing(filePath) {
+		return nil, fs.ErrorFileNotFound
+	}
+
+	// the large files are cached in chunks, the range is served from the chunks if its first chunk is cached
+	if file, err := sc.openFileChunks(ctx, filePath, fileRange, true); file != nil || err != nil {
+		return file, err
+	}
+
+	if sc.FileCache.IsFileTooLarge(filePath) {
+		return sc.openLargeFile(ctx, filePath, fileRange)
+	}
+
+	staleContent, staleMeta, staleness, hasStale := sc.FileCache.GetStaleFile(filePath)
+	if hasStale && staleness < sc.staleWhileRevalidate {
+		go sc.refreshFile(logger, filePath, staleContent, staleMeta)
+		return &loadedFile{content: staleContent, meta: staleMeta, fromCache: true}, nil
+	}
+
+	fileMeta, fileContent, err := sc.fetchFile(ctx, filePath, staleContent, staleMeta)
+	if err == nil {
+		return &loadedFile{content: fileContent, meta: fileMeta}, nil
+	}
+
+	if err == fs.ErrorFileTooLarge {
+		if fileRange == nil && fileMeta != nil && fileMeta.Body != nil {
+			// the whole file is streamed from the fetch without requesting it again
+			return &loadedFile{body: fileMeta.Body, meta: fileMeta}, nil
+		}
+		fs.CloseBody(fileMeta)
+		return sc.openLargeFile(ctx, filePath, fileRange)
+	}
+
+	if err != fs.ErrorFileNotFound && hasStale && staleness < sc.staleIfError {
+		logger.WithFields(logrus.Fields{
+			"file":  filePath,
+			"error": err.Error(),
+		}).Warn("serving-stale-file-on-error")
+		return &loadedFile{content: staleContent, meta: staleMeta, fromCache: true}, nil
+	}
+	return nil, err
+}
+
+// openLargeFile returns the range of the file that's too large to cache from its chunks or the file to be
+// streamed from the file service
+func (sc ServiceController) openLargeFile(ctx context.Context, filePath string, fileRange *fs.FileRange) (*loadedFile, error) {
+	if file, err := sc.openFileChunks(ctx, filePath, fileRange, false); file != nil || err != nil {
+		return file, err
+	}
+	return sc.openFileStream(ctx, filePath, fileRange)
+}
+
+// openFileStream returns the file to be streamed from the file service
+func (sc ServiceController) openFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*loadedFile, error) {
+	fileMeta, err := sc.FileService.GetFileStream(ctx, filePath, fileRange)
+	if err != nil {
+		return nil, err
+	}
+	return &loadedFile{body: fileMeta.Body, meta: fileMeta}, nil
+}
+
+// getFileSize returns the size of the file from its first cached chunk or from the first byte fetched from the
+// file service. Returns false if the file is empty or the size can't be found.
+func (sc ServiceController) getFileSize(ctx context.Context, filePath string) (int64, bool) {
+	_, meta, hasChunk := sc.FileCache.GetFileChunk(filePath, 0)
+	if !hasChunk {
+		var err error
+		meta, _, err = sc.FileService.GetFilePart(ctx, filePath, 0, 0, "")
+		if err != nil {
+			return 0, false
+		}
+	}
+	return parseContentRangeSize(aws.StringValue(meta.ContentRange))
+}
+
+// refreshFile fetches the expired file in the background. The expired file stays in the cache if the file
+// service fails.
+func (sc ServiceController) refreshFile(logger *logrus.Entry, filePath string, staleContent []byte, staleMeta *s3.GetObjectOutput) {
+	fileMeta, _, err := sc.fetchFile(context.Background(), filePath, staleContent, staleMeta)
+	if err == fs.ErrorFileTooLarge {
+		fs.CloseBody(fileMeta)
+	}
+	if err != nil && err != fs.ErrorFileNotFound && err != fs.ErrorFileTooLarge {
+		logger.WithFields(logrus.Fields{
+			"file":  filePath,
+			"error": err.Error(),
+		}).Warn("refreshing-stale-file-failed")
+	}
 }
 
-// GetBucketDomainNameFromHost returns the first subdomain
-// Returns "acme" for "acme.sepet.devingen.io"
-func GetBucketDomainNameFromHost(host string) string {
-	dotIndex := strings.IndexByte(host, '.')
-	if dotIndex < 0 {
-		return host
+// fetchFile gets the file from the file service and saves it into the cache. If the expired version of the
+// file is given, it's revalidated with a conditional request and renewed without downloading the content
+// again if it's not modified. The file is recorded as missing if it's not found. The file is recorded as too
+// large to stream it directly for a while if it's too large to cache, the file meta is returned with
+// ErrorFileTooLarge in that case and its Body must be closed by the caller.
+func (sc ServiceController) fetchFile(ctx context.Context, filePath string, staleContent []byte, staleMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	var fileMeta *s3.GetObjectOutput
+	var fileContent []byte
+	var err error
+	if staleMeta != nil {
+		fileMeta, fileContent, err = sc.FileService.GetFileIfModified(ctx, filePath, staleMeta)
+		if err == fs.ErrorFileNotModified {
+			fileMeta, fileContent, err = staleMeta, staleContent, nil
+		}
+	} else {
+		fileMeta, fileContent, err = sc.FileService.GetFile(ctx, filePath)
+	}
+
+	if err == fs.ErrorFileNotFound {
+		sc.FileCache.SaveMissingFile(filePath)
+	}
+	if err == fs.ErrorFileTooLarge {
+		// the old version of the file that has grown too large to be cached is removed as well
+		sc.FileCache.SaveLargeFile(filePath)
+		return fileMeta, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// save the file into cache
+	sc.FileCache.SaveFile(filePath, fileMeta, fileContent)
+	return fileMeta, fileContent, nil
+}
+
+// getFileRange returns the range requested with the Range and If-Range headers. Returns nil if the request
+// doesn't have a range.
+func getFileRange(r *http.Request) *fs.FileRange {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || r.Method != http.MethodGet {
+		return nil
+	}
+	return &fs.FileRange{
+		Range:   rangeHeader,
+		IfRange: r.Header.Get("If-Range"),
 	}
-	return host[:dotIndex]
 }
 
 func getFilePath(bucket *model.Bucket, path string) (string, string) {
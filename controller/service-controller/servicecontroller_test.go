@@ -1,19 +1,641 @@
 package srvcont
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal/daltest"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	peerfs "github.com/devingen/sepet-cdn/file-service/peer-file-service"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestGetFilePath(t *testing.T) {
-	assert.Equal(t,
-		"acme",
-		GetBucketDomainNameFromHost("acme.sepet.devingen.io"),
-		"incorrect domain",
-	)
-	assert.Equal(t,
-		"localhost",
-		GetBucketDomainNameFromHost("localhost"),
-		"incorrect domain",
-	)
+// testFileService returns the files in the map or the error if it's set. The ETag of the files is their content.
+// The files larger than maxBufferBytes are returned with their bodies to be streamed. The streamed ranges must be in the 'bytes=start-end' form.
+type testFileService struct {
+	files          map[string]string
+	err            error
+	fetchCount     int
+	streamCount    int
+	partCount      int
+	maxBufferBytes int
+
+	// streamBody is returned as the body of all the streamed files if it's set
+	streamBody io.ReadCloser
+
+	// streamRange is the range of the last streamed file
+	streamRange *fs.FileRange
+
+	// cacheControl is the Cache-Control of the files instead of 'no-cache' if it's set
+	cacheControl string
+
+	// ctx is the context of the last fetch
+	ctx context.Context
+}
+
+func (s *testFileService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	s.fetchCount++
+	s.ctx = ctx
+	meta, err := s.getMeta(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.maxBufferBytes > 0 && len(s.files[filePath]) > s.maxBufferBytes {
+		meta.Body = ioutil.NopCloser(strings.NewReader(s.files[filePath]))
+		return meta, nil, fs.ErrorFileTooLarge
+	}
+	return meta, []byte(s.files[filePath]), nil
+}
+
+func (s *testFileService) GetFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*s3.GetObjectOutput, error) {
+	s.streamCount++
+	s.streamRange = fileRange
+	meta, err := s.getMeta(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content := s.files[filePath]
+	if fileRange != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(fileRange.Range, "bytes=%d-%d", &start, &end); err != nil || end >= len(content) {
+			return nil, fs.ErrorRangeNotSatisfiable
+		}
+		meta.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		meta.ContentLength = aws.Int64(int64(end - start + 1))
+		content = content[start : end+1]
+	}
+	meta.Body = ioutil.NopCloser(strings.NewReader(content))
+	if s.streamBody != nil {
+		meta.Body = s.streamBody
+	}
+	return meta, nil
+}
+
+func (s *testFileService) GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error) {
+	s.partCount++
+	meta, err := s.getMeta(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if eTag != "" && eTag != aws.StringValue(meta.ETag) {
+		return nil, nil, fs.ErrorFileModified
+	}
+
+	content := s.files[filePath]
+	if start >= int64(len(content)) {
+		return nil, nil, fs.ErrorRangeNotSatisfiable
+	}
+	if end >= int64(len(content)) {
+		end = int64(len(content)) - 1
+	}
+	meta.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+	meta.ContentLength = aws.Int64(end - start + 1)
+	meta.CacheControl = aws.String("max-age=60")
+	return meta, []byte(content[start : end+1]), nil
+}
+
+func (s *testFileService) getMeta(filePath string) (*s3.GetObjectOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	content, exists := s.files[filePath]
+	if !exists {
+		return nil, fs.ErrorFileNotFound
+	}
+	cacheControl := "no-cache"
+	if s.cacheControl != "" {
+		cacheControl = s.cacheControl
+	}
+	now := time.Now()
+	return &s3.GetObjectOutput{
+		CacheControl:  aws.String(cacheControl),
+		ContentLength: aws.Int64(int64(len(content))),
+		ETag:          aws.String(content),
+		LastModified:  &now,
+	}, nil
+}
+
+func (s *testFileService) GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	if s.err == nil && s.files[filePath] == aws.StringValue(knownMeta.ETag) {
+		return nil, nil, fs.ErrorFileNotModified
+	}
+	return s.GetFile(ctx, filePath)
+}
+
+func newTestController(t *testing.T, fileService *testFileService, cacheConfig config.Cache) controller.IServiceController {
+	return newTestControllerForBucket(t, newTestBucket(), fileService, cacheConfig)
+}
+
+func newTestBucket() *model.Bucket {
+	now := time.Now()
+	return &model.Bucket{
+		UpdatedAt:      &now,
+		Folder:         aws.String("a1b2c3"),
+		Version:        aws.String("0.0.1"),
+		IndexPagePath:  aws.String("index.html"),
+		ErrorPagePath:  aws.String("index.html"),
+		IsCacheEnabled: aws.Bool(true),
+		Status:         aws.String("active"),
+	}
+}
+
+func newTestControllerForBucket(t *testing.T, bucket *model.Bucket, fileService *testFileService, cacheConfig config.Cache) controller.IServiceController {
+	ctx := log.WithLogger(context.Background(), logrus.New())
+
+	cacheConfig.ResetInterval = time.Hour
+	fileCache, err := filemapcache.New(ctx, cacheConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serviceController, err := New(ctx, &daltest.DAL{Bucket: bucket, MatchesAnyDomain: true}, fileCache, fileService, cacheConfig, config.Compression{Enabled: true, MinBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serviceController
+}
+
+func getFile(serviceController controller.IServiceController, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	serviceController.GetFile(w, httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io"+path, nil))
+	return w
+}
+
+func TestServesStaleFileOnError(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/index.html": "index"}}
+	serviceController := newTestController(t, fileService, config.Cache{StaleIfError: time.Hour})
+
+	w := getFile(serviceController, "/index.html")
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+
+	fileService.err = errors.New("connection-refused")
+
+	w = getFile(serviceController, "/index.html")
+	assert.Equal(t, http.StatusOK, w.Code, "stale file must be served on error")
+	assert.Equal(t, "index", w.Body.String(), "incorrect content")
+}
+
+func TestReturnsErrorWithoutStaleFile(t *testing.T) {
+	fileService := &testFileService{err: errors.New("connection-refused")}
+	serviceController := newTestController(t, fileService, config.Cache{StaleIfError: time.Hour})
+
+	w := getFile(serviceController, "/index.html")
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "incorrect status")
+}
+
+func TestServesErrorFileWhenFileIsNotFound(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/index.html": "index"}}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	w := getFile(serviceController, "/about")
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+	assert.Equal(t, "index", w.Body.String(), "error file must be served")
+}
+
+func TestRevalidatesExpiredFile(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/index.html": "index"}}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	getFile(serviceController, "/index.html")
+	w := getFile(serviceController, "/index.html")
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+	assert.Equal(t, "index", w.Body.String(), "not modified file must be served from the cache")
+	assert.Equal(t, 1, fileService.fetchCount, "not modified file must not be downloaded again")
+
+	fileService.files["a1b2c3/0.0.1/index.html"] = "new-index"
+
+	w = getFile(serviceController, "/index.html")
+	assert.Equal(t, "new-index", w.Body.String(), "modified file must be downloaded")
+	assert.Equal(t, 2, fileService.fetchCount, "modified file must be downloaded")
+}
+
+func TestServesStaleFileWhileRevalidating(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/index.html": "index"}}
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	cacheConfig := config.Cache{ResetInterval: time.Hour, StaleWhileRevalidate: time.Hour}
+	fileCache, err := filemapcache.New(ctx, cacheConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceController, err := New(ctx, &daltest.DAL{Bucket: newTestBucket(), MatchesAnyDomain: true}, fileCache, fileService, cacheConfig, config.Compression{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getFile(serviceController, "/index.html")
+	fileService.files["a1b2c3/0.0.1/index.html"] = "new-index"
+	fileService.cacheControl = "max-age=60"
+
+	w := getFile(serviceController, "/index.html")
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+	assert.Equal(t, "index", w.Body.String(), "stale file must be served without waiting for the refresh")
+
+	// the refresh runs in the background after the stale file is served
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		content, _, _, _ := fileCache.GetStaleFile("a1b2c3/0.0.1/index.html")
+		if string(content) == "new-index" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale file must be refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w = getFile(serviceController, "/index.html")
+	assert.Equal(t, "new-index", w.Body.String(), "refreshed file must be served from the cache")
+	assert.Equal(t, 2, fileService.fetchCount, "refreshed file must not be downloaded again")
+}
+
+func TestCompressesTextFiles(t *testing.T) {
+	content := strings.Repeat("console.log('sepet');\n", 100)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/app.js": content}}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	for _, acceptEncoding := range []string{"", "gzip, deflate", "gzip, br", "br;q=0, gzip"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/app.js", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		serviceController.GetFile(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), "incorrect vary header")
+		assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"), "incorrect content type")
+
+		var reader io.Reader = w.Body
+		switch w.Header().Get("Content-Encoding") {
+		case "gzip":
+			gzipReader, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader = gzipReader
+		case "br":
+			reader = brotli.NewReader(w.Body)
+		}
+		decoded, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, content, string(decoded), "incorrect content for '"+acceptEncoding+"'")
+		assert.Equal(t, negotiateEncoding(acceptEncoding), w.Header().Get("Content-Encoding"), "incorrect encoding")
+	}
+	assert.Equal(t, 1, fileService.fetchCount, "file must be fetched once")
+}
+
+func TestDoesNotCompressRanges(t *testing.T) {
+	content := strings.Repeat("console.log('sepet');\n", 100)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/app.js": content}}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/app.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	r.Header.Set("Range", "bytes=0-9")
+	serviceController.GetFile(w, r)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code, "incorrect status")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"), "range must not be compressed")
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), "incorrect vary header")
+	assert.Equal(t, fmt.Sprintf("bytes 0-9/%d", len(content)), w.Header().Get("Content-Range"), "incorrect content range")
+	assert.Equal(t, content[:10], w.Body.String(), "range of the uncompressed content must be served")
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "", negotiateEncoding(""), "incorrect encoding")
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate"), "incorrect encoding")
+	assert.Equal(t, "br", negotiateEncoding("gzip, deflate, br"), "incorrect encoding")
+	assert.Equal(t, "gzip", negotiateEncoding("br;q=0.5, gzip"), "incorrect encoding")
+	assert.Equal(t, "br", negotiateEncoding("*"), "incorrect encoding")
+	assert.Equal(t, "", negotiateEncoding("identity, *;q=0"), "incorrect encoding")
+}
+
+func TestServesPrecompressedFiles(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{
+		"a1b2c3/0.0.1/app.js":    "plain",
+		"a1b2c3/0.0.1/app.js.gz": "gzip-compressed",
+		"a1b2c3/0.0.1/lib.js":    "plain-lib",
+	}}
+	bucket := newTestBucket()
+	bucket.IsPrecompressedFilesEnabled = aws.Bool(true)
+	serviceController := newTestControllerForBucket(t, bucket, fileService, config.Cache{NotFoundTTL: time.Minute})
+
+	getFileWithEncoding := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io"+path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		serviceController.GetFile(w, r)
+		return w
+	}
+
+	w := getFileWithEncoding("/app.js", "gzip, br")
+	assert.Equal(t, "gzip-compressed", w.Body.String(), "gzip sibling must be served when brotli sibling is missing")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), "incorrect encoding")
+	assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"), "original content type must be used")
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), "incorrect vary header")
+
+	w = getFileWithEncoding("/app.js", "")
+	assert.Equal(t, "plain", w.Body.String(), "plain file must be served when encoding is not accepted")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"), "incorrect encoding")
+
+	w = getFileWithEncoding("/lib.js", "gzip")
+	assert.Equal(t, "plain-lib", w.Body.String(), "plain file must be served when there is no sibling")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"), "incorrect encoding")
+}
+
+func TestLooksUpPrecompressedFilesOnlyWhenNeeded(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{
+		"a1b2c3/0.0.1/app.js":      "plain",
+		"a1b2c3/0.0.1/logo.png":    "image",
+		"a1b2c3/0.0.1/logo.png.gz": "gzip-compressed",
+	}}
+	bucket := newTestBucket()
+	bucket.IsPrecompressedFilesEnabled = aws.Bool(true)
+	bucket.IsCacheEnabled = aws.Bool(false)
+	serviceController := newTestControllerForBucket(t, bucket, fileService, config.Cache{NotFoundTTL: time.Minute})
+
+	getFileWithEncoding := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io"+path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		serviceController.GetFile(w, r)
+		return w
+	}
+
+	w := getFileWithEncoding("/logo.png", "gzip")
+	assert.Equal(t, "image", w.Body.String(), "siblings of the files that are not compressible must not be served")
+	assert.Equal(t, "", w.Header().Get("Vary"), "incorrect vary header")
+	assert.Equal(t, 1, fileService.streamCount, "siblings of the files that are not compressible must not be looked up")
+
+	getFileWithEncoding("/app.js", "gzip, br")
+	assert.Equal(t, 4, fileService.streamCount, "both siblings must be looked up")
+
+	w = getFileWithEncoding("/app.js", "gzip, br")
+	assert.Equal(t, "plain", w.Body.String(), "plain file must be served when there is no sibling")
+	assert.Equal(t, 5, fileService.streamCount, "missing siblings must not be looked up again")
+}
+
+func TestStreamsFilesTooLargeToCache(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/video.mp4": content}, maxBufferBytes: 10}
+	serviceController := newTestController(t, fileService, config.Cache{LargeFileTTL: time.Minute})
+
+	w := getFile(serviceController, "/video.mp4")
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+	assert.Equal(t, content, w.Body.String(), "incorrect content")
+	assert.Equal(t, "100", w.Header().Get("Content-Length"), "incorrect content length")
+	assert.Equal(t, "video/mp4", w.Header().Get("Content-Type"), "incorrect content type")
+	assert.Equal(t, 1, fileService.fetchCount, "incorrect fetch count")
+	assert.Equal(t, 0, fileService.streamCount, "large file must be streamed from the fetch")
+
+	w = getFile(serviceController, "/video.mp4")
+	assert.Equal(t, content, w.Body.String(), "incorrect content")
+	assert.Equal(t, 1, fileService.fetchCount, "large file must not be fetched again")
+	assert.Equal(t, 1, fileService.streamCount, "large file must be streamed")
+}
+
+func TestStreamsFilesOfBucketsWithCacheDisabled(t *testing.T) {
+	content := strings.Repeat("console.log('sepet');\n", 100)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/app.js": content}}
+	bucket := newTestBucket()
+	bucket.IsCacheEnabled = aws.Bool(false)
+	serviceController := newTestControllerForBucket(t, bucket, fileService, config.Cache{})
+
+	w := getFile(serviceController, "/app.js")
+	assert.Equal(t, content, w.Body.String(), "incorrect content")
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Content-Length"), "incorrect content length")
+	assert.Equal(t, 0, fileService.fetchCount, "file must not be read into the memory")
+
+	// the streamed files are compressed while they're streamed
+	r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/app.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	serviceController.GetFile(w, r)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), "incorrect encoding")
+	assert.Equal(t, "", w.Header().Get("Content-Length"), "compressed stream must not have content length")
+
+	gzipReader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, content, string(decoded), "incorrect content")
+}
+
+// blockingBody blocks the reads until it's closed
+type blockingBody struct {
+	closed chan struct{}
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, errors.New("body-closed")
+}
+
+func (b *blockingBody) Close() error {
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
+
+func TestStopsStreamingWhenClientDisconnects(t *testing.T) {
+	body := &blockingBody{closed: make(chan struct{})}
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/video.mp4": "content"}, streamBody: body}
+	bucket := newTestBucket()
+	bucket.IsCacheEnabled = aws.Bool(false)
+	serviceController := newTestControllerForBucket(t, bucket, fileService, config.Cache{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/video.mp4", nil).WithContext(ctx)
+
+	served := make(chan struct{})
+	go func() {
+		serviceController.GetFile(httptest.NewRecorder(), r)
+		close(served)
+	}()
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streaming must stop when the client disconnects")
+	}
+}
+
+func TestForwardsRangeOfStreamedFiles(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/video.mp4": content}}
+	bucket := newTestBucket()
+	bucket.IsCacheEnabled = aws.Bool(false)
+	serviceController := newTestControllerForBucket(t, bucket, fileService, config.Cache{})
+
+	getRange := func(rangeHeader string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/video.mp4", nil)
+		r.Header.Set("Range", rangeHeader)
+		r.Header.Set("If-Range", `"etag"`)
+		serviceController.GetFile(w, r)
+		return w
+	}
+
+	w := getRange("bytes=12-15")
+	assert.Equal(t, http.StatusPartialContent, w.Code, "incorrect status")
+	assert.Equal(t, "2345", w.Body.String(), "incorrect content")
+	assert.Equal(t, "bytes 12-15/100", w.Header().Get("Content-Range"), "incorrect content range")
+	assert.Equal(t, "4", w.Header().Get("Content-Length"), "incorrect content length")
+	assert.Equal(t, &fs.FileRange{Range: "bytes=12-15", IfRange: `"etag"`}, fileService.streamRange, "range must be forwarded")
+
+	w = getRange("bytes=100-200")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code, "incorrect status")
+	assert.Equal(t, "bytes */100", w.Header().Get("Content-Range"), "size must be given with the unsatisfiable range")
+}
+
+func TestFetchesFilesWithRequestContext(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/app.js": "app"}}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	type contextKey struct{}
+	ctx := context.WithValue(context.Background(), contextKey{}, "request")
+	r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/app.js", nil).WithContext(ctx)
+	serviceController.GetFile(httptest.NewRecorder(), r)
+	assert.Equal(t, "request", fileService.ctx.Value(contextKey{}), "file must be fetched with the request context")
+}
+
+func TestCachesRangesOfLargeFilesInChunks(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/video.mp4": content}, maxBufferBytes: 10}
+	serviceController := newTestController(t, fileService, config.Cache{ChunkBytes: 10})
+
+	getRange := func(rangeHeader string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/video.mp4", nil)
+		r.Header.Set("Range", rangeHeader)
+		serviceController.GetFile(w, r)
+		return w
+	}
+
+	w := getRange("bytes=15-34")
+	assert.Equal(t, http.StatusPartialContent, w.Code, "incorrect status")
+	assert.Equal(t, content[15:35], w.Body.String(), "incorrect content")
+	assert.Equal(t, "bytes 15-34/100", w.Header().Get("Content-Range"), "incorrect content range")
+	assert.Equal(t, "20", w.Header().Get("Content-Length"), "incorrect content length")
+	assert.Equal(t, 3, fileService.partCount, "chunks of the range must be fetched")
+
+	w = getRange("bytes=20-29")
+	assert.Equal(t, content[20:30], w.Body.String(), "incorrect content")
+	assert.Equal(t, 3, fileService.partCount, "cached chunk must not be fetched again")
+
+	w = getRange("bytes=95-")
+	assert.Equal(t, content[95:], w.Body.String(), "incorrect content")
+	assert.Equal(t, "bytes 95-99/100", w.Header().Get("Content-Range"), "incorrect content range")
+	assert.Equal(t, 0, fileService.streamCount, "ranges must be served from the chunks")
+}
+
+func TestCachesOnlyWindowOfOpenEndedRanges(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/video.mp4": content}, maxBufferBytes: 10}
+	serviceController := newTestController(t, fileService, config.Cache{MaxBytes: 50, ChunkBytes: 10, ChunkWindow: 2})
+
+	getRange := func(rangeHeader string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://acme.sepet.devingen.io/video.mp4", nil)
+		r.Header.Set("Range", rangeHeader)
+		serviceController.GetFile(w, r)
+		return w
+	}
+
+	// the file is larger than the cache
+	w := getRange("bytes=0-")
+	assert.Equal(t, content, w.Body.String(), "incorrect content")
+	assert.Equal(t, 2, fileService.partCount, "chunks in the window must be fetched")
+	assert.Equal(t, 1, fileService.streamCount, "rest of the range must be streamed at once")
+	assert.Equal(t, "bytes=20-99", fileService.streamRange.Range, "incorrect streamed range")
+
+	w = getRange("bytes=0-19")
+	assert.Equal(t, content[:20], w.Body.String(), "incorrect content")
+	assert.Equal(t, 2, fileService.partCount, "chunks in the window must stay in the cache")
+
+	w = getRange("bytes=20-29")
+	assert.Equal(t, content[20:30], w.Body.String(), "incorrect content")
+	assert.Equal(t, 3, fileService.partCount, "chunks out of the window must not be cached")
+}
+
+func TestServesFilesToPeers(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/app.js": "app"}}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	getPeerFile := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serviceController.GetPeerFile(w, httptest.NewRequest(http.MethodGet, peerfs.FilePath+"?path="+path, nil))
+		return w
+	}
+
+	w := getPeerFile("a1b2c3/0.0.1/app.js")
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect status")
+	assert.Equal(t, "app", w.Body.String(), "incorrect content")
+	meta, err := peerfs.DecodeMeta(w.Header().Get(peerfs.MetaHeader))
+	assert.Nil(t, err, "meta must be sent")
+	assert.Equal(t, "app", aws.StringValue(meta.ETag), "incorrect meta")
+
+	w = getPeerFile("a1b2c3/0.0.1/missing.js")
+	assert.Equal(t, http.StatusNotFound, w.Code, "incorrect status")
+}
+
+func TestServesCachedFileToPeersUntilPurged(t *testing.T) {
+	fileService := &testFileService{files: map[string]string{"a1b2c3/0.0.1/app.js": "app"}, cacheControl: "max-age=60"}
+	serviceController := newTestController(t, fileService, config.Cache{})
+
+	getPeerFile := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, peerfs.FilePath+"?path=a1b2c3/0.0.1/app.js", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		serviceController.GetPeerFile(w, r)
+		return w
+	}
+
+	getPeerFile("")
+	fileService.files["a1b2c3/0.0.1/app.js"] = "app-v2"
+
+	w := getPeerFile("app")
+	assert.Equal(t, http.StatusNotModified, w.Code, "cached file must be served to the peer that has it")
+
+	w = getPeerFile("")
+	assert.Equal(t, "app", w.Body.String(), "cached file must be served to the peer that doesn't have it")
+	assert.Equal(t, 1, fileService.fetchCount, "cached file must not be fetched")
+
+	// the purge is forwarded by the node that received it
+	w = httptest.NewRecorder()
+	serviceController.PurgePeerFiles(w, httptest.NewRequest(http.MethodPost, peerfs.PurgePath+"?path=a1b2c3/&prefix=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "incorrect purge status")
+
+	w = getPeerFile("")
+	assert.Equal(t, "app-v2", w.Body.String(), "purged file must be fetched")
 }
@@ -0,0 +1,118 @@
+package srvcont
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// serveFileStream copies the body of the file to the response without reading the whole file into the memory.
+// The body is closed when the client disconnects to stop reading the file from the file service. The given
+// encoding is the encoding of the precompressed file, the other files are compressed while they're streamed
+// if the client accepts it. The partial files returned for the range requests are relayed with their
+// Content-Range.
+func (sc ServiceController) serveFileStream(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, bucket *model.Bucket, name, encoding string, file *loadedFile) {
+	size := aws.Int64Value(file.meta.ContentLength)
+	isPartial := file.meta.ContentRange != nil
+
+	compressingEncoding := ""
+	if encoding != "" {
+		setEncodingHeaders(w, getPrecompressedContentType(name), encoding)
+	} else {
+		contentType := w.Header().Get("Content-Type")
+		if contentType == "" {
+			contentType = getStreamContentType(name, file)
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		compressingEncoding = sc.negotiateFileEncoding(w, r, contentType, size, file.meta)
+		if isPartial {
+			// the range is the range of the uncompressed content
+			compressingEncoding = ""
+		}
+		if compressingEncoding != "" {
+			setEncodingHeaders(w, contentType, compressingEncoding)
+		} else {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+	}
+
+	lastModified := pickLastModified(bucket, file.meta)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	if isNotModifiedSince(r, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// the size of the compressed content is not known before it's streamed
+	if compressingEncoding == "" && file.meta.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if isPartial {
+		w.Header().Set("Content-Range", aws.StringValue(file.meta.ContentRange))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// stop reading the file when the client disconnects
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			file.body.Close()
+		case <-done:
+		}
+	}()
+
+	var writer io.Writer = w
+	if compressingEncoding != "" {
+		encoder := newEncoder(w, compressingEncoding)
+		defer encoder.Close()
+		writer = encoder
+	}
+
+	written, err := io.Copy(writer, file.body)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"written": written,
+			"error":   err.Error(),
+		}).Debug("streaming-file-interrupted")
+	}
+}
+
+// getStreamContentType returns the content type of the streamed file by its extension or the type given
+// by the file service since the content can't be sniffed
+func getStreamContentType(name string, file *loadedFile) string {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = aws.StringValue(file.meta.ContentType)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
+
+// isNotModifiedSince returns true if the request has an If-Modified-Since header that's not before the last
+// modification date. The dates are compared in seconds since the header doesn't have a smaller unit.
+func isNotModifiedSince(r *http.Request, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
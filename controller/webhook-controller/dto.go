@@ -0,0 +1,20 @@
+package webhookcont
+
+import "github.com/devingen/sepet-cdn/model"
+
+// UpdateBucketRequest defines the bucket that's changed in the Sepet API. At least one of the ID and the bucket
+// must be given.
+type UpdateBucketRequest struct {
+	// ID is the ID of the changed bucket. The bucket is fetched from the API if only the ID is given and it's
+	// removed if the API doesn't have it anymore.
+	ID *string `json:"id,omitempty"`
+
+	// Bucket is the whole changed bucket with its ID and revision. It replaces the current bucket unless the
+	// current one has a newer revision.
+	Bucket *model.Bucket `json:"bucket,omitempty"`
+}
+
+// UpdateBucketResponse contains the ID of the updated bucket
+type UpdateBucketResponse struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,88 @@
+package webhookcont
+
+import (
+	"context"
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// UpdateBucket updates the bucket in the DAL and invalidates its cached files right away without waiting for
+// the next bucket list refresh
+func (wc WebhookController) UpdateBucket(ctx context.Context, req core.Request) (interface{}, int, error) {
+	if err := controller.AssertAPIKey(req, wc.apiKey); err != nil {
+		return nil, 0, err
+	}
+
+	if req.HTTPMethod != http.MethodPost {
+		return nil, 0, core.NewError(http.StatusMethodNotAllowed, "method-not-allowed")
+	}
+
+	var body UpdateBucketRequest
+	if err := req.AssertBody(&body); err != nil {
+		return nil, 0, err
+	}
+
+	id, err := getBucketID(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if body.Bucket != nil {
+		if err := assertBucket(body.Bucket); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := wc.DAL.UpdateBucket(id, body.Bucket); err != nil {
+		if err == dal.ErrorBucketOutdated {
+			return nil, 0, core.NewError(http.StatusConflict, err.Error())
+		}
+		wc.logger.WithFields(logrus.Fields{
+			"id":    id,
+			"error": err.Error(),
+		}).Error("updating-bucket-failed")
+		return nil, 0, core.NewError(http.StatusBadGateway, "updating-bucket-failed")
+	}
+	return UpdateBucketResponse{ID: id}, http.StatusOK, nil
+}
+
+// getBucketID returns the ID of the bucket in the request
+func getBucketID(body UpdateBucketRequest) (string, error) {
+	if body.Bucket == nil {
+		if body.ID == nil || *body.ID == "" {
+			return "", core.NewError(http.StatusBadRequest, "one-of-id-bucket-required")
+		}
+		return *body.ID, nil
+	}
+
+	if body.Bucket.ID.IsZero() {
+		return "", core.NewError(http.StatusBadRequest, "bucket-id-missing")
+	}
+	id := body.Bucket.ID.Hex()
+	if body.ID != nil && *body.ID != id {
+		return "", core.NewError(http.StatusBadRequest, "bucket-id-mismatch")
+	}
+	return id, nil
+}
+
+// assertBucket returns an error if the bucket misses the fields that are needed to replace the current bucket.
+// The bucket replaces the current one as a whole, so a partial bucket would drop the missing fields.
+func assertBucket(bucket *model.Bucket) error {
+	if bucket.Revision == 0 {
+		return core.NewError(http.StatusBadRequest, "bucket-revision-missing")
+	}
+	if core.StringValue(bucket.Domain) == "" {
+		return core.NewError(http.StatusBadRequest, "bucket-domain-missing")
+	}
+	if core.StringValue(bucket.Folder) == "" {
+		return core.NewError(http.StatusBadRequest, "bucket-folder-missing")
+	}
+	if core.StringValue(bucket.Status) == "" {
+		return core.NewError(http.StatusBadRequest, "bucket-status-missing")
+	}
+	return nil
+}
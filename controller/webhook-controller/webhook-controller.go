@@ -0,0 +1,32 @@
+package webhookcont
+
+import (
+	"context"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookController implements IWebhookController interface
+type WebhookController struct {
+	logger *logrus.Logger
+	DAL    dal.DAL
+
+	// apiKey is the key that the webhook requests must have in the 'api-key' header
+	apiKey string
+}
+
+// New generates new WebhookController
+func New(ctx context.Context, dal dal.DAL, apiKey string) (controller.IWebhookController, error) {
+	logger, err := log.Of(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return WebhookController{
+		DAL:    dal,
+		logger: logger,
+		apiKey: apiKey,
+	}, nil
+}
@@ -0,0 +1,143 @@
+package webhookcont
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	core "github.com/devingen/api-core"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/devingen/sepet-cdn/controller"
+	"github.com/devingen/sepet-cdn/dal/dalcache"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	bucketID       = "5f1a2b3c4d5e6f7a8b9c0d1e"
+	failingID      = "5f1a2b3c4d5e6f7a8b9c0d1f"
+	updatedBucket  = `{"_id":"5f1a2b3c4d5e6f7a8b9c0d1e","_revision":3,"domain":"acme","folder":"a1b2c3","version":"0.0.2","status":"active"}`
+	outdatedBucket = `{"_id":"5f1a2b3c4d5e6f7a8b9c0d1e","_revision":1,"domain":"acme","folder":"a1b2c3","version":"0.0.0","status":"active"}`
+)
+
+// newTestController returns the controller with a DAL that has the 'acme' bucket at revision 2. The API returns
+// the bucket at revision 4 when it's fetched by its ID and fails for the failingID. The returned function closes
+// the DAL and the API.
+func newTestController(t *testing.T) (controller.IWebhookController, *dalcache.DALCache, func()) {
+	id, _ := primitive.ObjectIDFromHex(bucketID)
+	bucket := model.Bucket{
+		ID:       id,
+		Revision: 2,
+		Domain:   aws.String("acme"),
+		Folder:   aws.String("a1b2c3"),
+		Version:  aws.String("0.0.1"),
+		Status:   aws.String("active"),
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/buckets":
+			json.NewEncoder(w).Encode(dalcache.GetBucketListResponse{Results: []*model.Bucket{&bucket}})
+		case "/buckets/" + bucketID:
+			fetched := bucket
+			fetched.Revision = 4
+			fetched.Version = aws.String("0.0.3")
+			json.NewEncoder(w).Encode(fetched)
+		case "/buckets/" + failingID:
+			http.Error(w, "api-is-down", http.StatusInternalServerError)
+		default:
+			http.Error(w, "not-found", http.StatusNotFound)
+		}
+	}))
+
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	fileCache, err := filemapcache.New(ctx, config.Cache{ResetInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dal, err := dalcache.New(ctx, fileCache, api.URL, "", nil, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeAll := func() {
+		dal.Close()
+		api.Close()
+	}
+
+	webhookController, err := New(ctx, dal, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webhookController, dal, closeAll
+}
+
+func updateBucketRequest(apiKey, body string) core.Request {
+	return core.Request{
+		HTTPMethod: http.MethodPost,
+		Headers:    map[string]string{"api-key": apiKey},
+		Body:       body,
+	}
+}
+
+func TestUpdateBucketRequiresAPIKey(t *testing.T) {
+	webhookController, dal, closeAll := newTestController(t)
+	defer closeAll()
+
+	_, _, err := webhookController.UpdateBucket(context.Background(), updateBucketRequest("wrong", `{"bucket":`+updatedBucket+`}`))
+	assert.Equal(t, http.StatusUnauthorized, err.(*core.DVNError).StatusCode, "incorrect status")
+	assert.Equal(t, "0.0.1", *dal.GetBucket("acme").Version, "bucket must not be updated")
+}
+
+func TestUpdatesBucket(t *testing.T) {
+	webhookController, dal, closeAll := newTestController(t)
+	defer closeAll()
+
+	result, status, err := webhookController.UpdateBucket(context.Background(), updateBucketRequest("secret", `{"bucket":`+updatedBucket+`}`))
+	assert.Nil(t, err, "update must succeed")
+	assert.Equal(t, http.StatusOK, status, "incorrect status")
+	assert.Equal(t, UpdateBucketResponse{ID: bucketID}, result, "incorrect response")
+	assert.Equal(t, "0.0.2", *dal.GetBucket("acme").Version, "bucket must be updated")
+
+	_, _, err = webhookController.UpdateBucket(context.Background(), updateBucketRequest("secret", `{"id":"`+bucketID+`"}`))
+	assert.Nil(t, err, "update must succeed")
+	assert.Equal(t, "0.0.3", *dal.GetBucket("acme").Version, "bucket must be fetched if only the ID is given")
+}
+
+func TestRejectsOutdatedBucketUpdates(t *testing.T) {
+	webhookController, dal, closeAll := newTestController(t)
+	defer closeAll()
+
+	_, _, err := webhookController.UpdateBucket(context.Background(), updateBucketRequest("secret", `{"bucket":`+outdatedBucket+`}`))
+	assert.Equal(t, http.StatusConflict, err.(*core.DVNError).StatusCode, "incorrect status")
+	assert.Equal(t, "0.0.1", *dal.GetBucket("acme").Version, "bucket must not be replaced by an older revision")
+}
+
+func TestRejectsInvalidBucketUpdates(t *testing.T) {
+	webhookController, dal, closeAll := newTestController(t)
+	defer closeAll()
+
+	for _, body := range []string{
+		`{}`,
+		`{"bucket":{"version":"0.0.2"}}`,
+		`{"id":"` + failingID + `","bucket":` + updatedBucket + `}`,
+		`{"bucket":{"_id":"` + bucketID + `","version":"0.0.2"}}`,
+		`{"bucket":{"_id":"` + bucketID + `","_revision":3,"version":"0.0.2"}}`,
+		`{"bucket":{"_id":"` + bucketID + `","_revision":3,"domain":"acme","version":"0.0.2","status":"active"}}`,
+	} {
+		_, _, err := webhookController.UpdateBucket(context.Background(), updateBucketRequest("secret", body))
+		assert.Equal(t, http.StatusBadRequest, err.(*core.DVNError).StatusCode, "incorrect status for "+body)
+	}
+	assert.Equal(t, "0.0.1", *dal.GetBucket("acme").Version, "bucket must not be updated")
+	assert.Equal(t, "a1b2c3", *dal.GetBucket("acme").Folder, "bucket must not lose its fields")
+
+	_, _, err := webhookController.UpdateBucket(context.Background(), updateBucketRequest("secret", `{"id":"`+failingID+`"}`))
+	assert.Equal(t, http.StatusBadGateway, err.(*core.DVNError).StatusCode, "incorrect status")
+}
@@ -1,11 +1,35 @@
 package dal
 
 import (
+	"errors"
 	"github.com/devingen/sepet-cdn/model"
 )
 
+// ErrorBucketNotFound used when there is no bucket for the host
+var ErrorBucketNotFound = errors.New("bucket-not-found")
+
+// ErrorHostNotServed used when the host is neither a custom hostname of a bucket nor under the root domains
+var ErrorHostNotServed = errors.New("host-not-served")
+
+// ErrorBucketOutdated used when the updated bucket has an older revision than the current one
+var ErrorBucketOutdated = errors.New("bucket-outdated")
+
 // DAL defines the Data Access Layer for buckets
 type DAL interface {
 	GetBucket(domain string) *model.Bucket
+
+	// GetBucketByHost returns the bucket that has the host as a custom hostname or the bucket that has the
+	// subdomain of the host under the root domains as its domain or alias. The host may have a port.
+	GetBucketByHost(host string) (*model.Bucket, error)
+
+	// UpdateBucket replaces the bucket with the ID and invalidates its cached files if it's changed. The bucket is
+	// fetched from the API if it's not given and it's removed if the API doesn't have it. Returns
+	// ErrorBucketOutdated if the bucket has an older revision than the current one.
+	UpdateBucket(id string, bucket *model.Bucket) error
+
+	// IsStale returns true if the buckets couldn't be synced with the API since the startup and the last known
+	// buckets are used
+	IsStale() bool
+
 	Refresh()
 }
@@ -0,0 +1,55 @@
+package dalcache
+
+import (
+	"encoding/json"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// saveBackup writes the buckets into the backup file to be loaded when the API is unreachable on startup
+func (dal *DALCache) saveBackup(buckets []*model.Bucket) {
+	if dal.backupFile == "" {
+		return
+	}
+
+	if err := writeBucketList(dal.backupFile, buckets); err != nil {
+		dal.logger.WithFields(logrus.Fields{
+			"path":  dal.backupFile,
+			"error": err.Error(),
+		}).Error("saving-bucket-list-backup-failed")
+	}
+}
+
+// writeBucketList writes the buckets into the file. The file is replaced at once to not leave a partially
+// written list if the process is stopped while writing.
+func writeBucketList(path string, buckets []*model.Bucket) error {
+	content, err := json.Marshal(GetBucketListResponse{Results: buckets})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readBucketList reads the buckets written by writeBucketList
+func readBucketList(path string) ([]*model.Bucket, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var response GetBucketListResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, err
+	}
+	return response.Results, nil
+}
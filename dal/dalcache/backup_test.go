@@ -0,0 +1,76 @@
+package dalcache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadsBucketListBackupWhenAPIIsDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sepet-cdn-dal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backupFile := filepath.Join(dir, "buckets", "buckets.json")
+
+	acme := newTestBucket("a1b2c3", "0.0.1", "header")
+	acme.Domain = aws.String("acme")
+
+	isDown := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDown {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetBucketListResponse{Results: []*model.Bucket{acme}})
+	}))
+	defer api.Close()
+
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	fileCache, err := filemapcache.New(ctx, config.Cache{ResetInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dal, err := New(ctx, fileCache, api.URL, "", nil, backupFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dal.Close()
+	assert.False(t, dal.IsStale(), "synced buckets must not be stale")
+
+	// restart while the API is down
+	isDown = true
+	_, err = New(ctx, fileCache, api.URL, "", nil, "", time.Hour)
+	assert.NotNil(t, err, "startup must fail without backup")
+
+	dal, err = New(ctx, fileCache, api.URL, "", nil, backupFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dal.Close()
+	assert.True(t, dal.IsStale(), "buckets must be stale")
+	assert.Equal(t, acme.ID, dal.GetBucket("acme").ID, "bucket must be loaded from the backup")
+
+	dal.Refresh()
+	assert.True(t, dal.IsStale(), "buckets must be stale until the API is up")
+
+	isDown = false
+	dal.Refresh()
+	assert.False(t, dal.IsStale(), "buckets must not be stale after syncing")
+}
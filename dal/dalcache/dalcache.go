@@ -8,88 +8,268 @@ import (
 	"github.com/devingen/sepet-cdn/model"
 	"github.com/go-resty/resty/v2"
 	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// updateTicker controls the frequency of underlying data updating.
-var updateTicker *time.Ticker
-
 // DALCache implements DAL interface with map cache storage
 type DALCache struct {
+	// isStale is 1 if the buckets are loaded from the backup file and not synced with the API yet.
+	// It's updated atomically and kept at the beginning of the struct to be aligned.
+	isStale int32
+
 	context    context.Context
 	logger     *logrus.Logger
 	Buckets    []*model.Bucket
 	FileCache  cache.IFileCache
 	HTTPClient *resty.Client
 	apiURL     string
+
+	// rootDomains are the normalized domains that the buckets are served under by their domains
+	rootDomains []string
+
+	// backupFile is the file that the last synced buckets are written into. It's disabled if it's empty.
+	backupFile string
+
+	// index holds the *bucketIndex of the buckets
+	index atomic.Value
+
+	// syncLock guards the state of the last sync and prevents the concurrent refreshes
+	syncLock sync.Mutex
+	lastSync syncState
+
+	// updateTicker controls the frequency of underlying data updating and stop ends the updates
+	updateTicker *time.Ticker
+	stop         chan struct{}
+	stopOnce     sync.Once
 }
 
-func New(ctx context.Context, fileCache cache.IFileCache, apiURL, apiKey string, dalUpdateInterval time.Duration) (*DALCache, error) {
+func New(ctx context.Context, fileCache cache.IFileCache, apiURL, apiKey string, rootDomains []string, backupFile string, dalUpdateInterval time.Duration) (*DALCache, error) {
 	logger, err := log.Of(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	normalizedRootDomains := make([]string, 0, len(rootDomains))
+	for _, rootDomain := range rootDomains {
+		if rootDomain = normalizeHost(rootDomain); rootDomain != "" {
+			normalizedRootDomains = append(normalizedRootDomains, rootDomain)
+		}
+	}
+	if len(normalizedRootDomains) == 0 {
+		logger.Warn("serving-buckets-under-any-host-without-root-domains")
+	}
+
 	dal := &DALCache{
-		context:    ctx,
-		logger:     logger,
-		FileCache:  fileCache,
-		HTTPClient: resty.New().SetHeader("api-key", apiKey),
-		apiURL:     apiURL,
+		context:     ctx,
+		logger:      logger,
+		FileCache:   fileCache,
+		HTTPClient:  resty.New().SetHeader("api-key", apiKey),
+		apiURL:      apiURL,
+		rootDomains: normalizedRootDomains,
+		backupFile:  backupFile,
+		stop:        make(chan struct{}),
 	}
 
-	buckets, _, err := dal.fetchBucketList()
+	buckets, _, err := dal.syncBucketList()
 	if err != nil {
-		return nil, err
+		if backupFile == "" {
+			return nil, err
+		}
+
+		// start with the last known buckets instead of failing while the API is down
+		backupBuckets, backupErr := readBucketList(backupFile)
+		if backupErr != nil {
+			logger.WithFields(logrus.Fields{
+				"path":  backupFile,
+				"error": backupErr.Error(),
+			}).Error("loading-bucket-list-backup-failed")
+			return nil, err
+		}
+
+		logger.WithFields(logrus.Fields{
+			"path":        backupFile,
+			"bucketCount": len(backupBuckets),
+			"error":       err.Error(),
+		}).Warn("using-bucket-list-backup")
+		buckets = backupBuckets
+		dal.isStale = 1
+	} else {
+		dal.saveBackup(buckets)
 	}
-	dal.Buckets = buckets
+	dal.setBuckets(buckets)
+	fileCache.SetQuotas(buckets)
 
-	// update the data periodically
-	updateTicker = time.NewTicker(dalUpdateInterval)
+	// update the data periodically in case a webhook call is missed, until the DAL is closed
+	dal.updateTicker = time.NewTicker(dalUpdateInterval)
 	go func() {
-		for range updateTicker.C {
-			dal.Refresh()
+		for {
+			select {
+			case <-dal.updateTicker.C:
+				dal.Refresh()
+			case <-dal.stop:
+				return
+			}
 		}
 	}()
 
 	return dal, nil
 }
 
+// Close stops updating the buckets periodically
+func (dal *DALCache) Close() {
+	dal.stopOnce.Do(func() {
+		dal.updateTicker.Stop()
+		close(dal.stop)
+	})
+}
+
 func (dal *DALCache) GetBucket(domain string) *model.Bucket {
-	for _, bucket := range dal.Buckets {
-		if core.StringValue(bucket.Domain) == domain {
-			return bucket
-		}
-	}
-	return nil
+	return dal.getIndex().domains[normalizeHost(domain)]
+}
+
+func (dal *DALCache) GetBucketByHost(host string) (*model.Bucket, error) {
+	return dal.getIndex().getByHost(host, dal.rootDomains)
+}
+
+// IsStale returns true if the buckets are loaded from the backup file and not synced with the API yet
+func (dal *DALCache) IsStale() bool {
+	return atomic.LoadInt32(&dal.isStale) == 1
 }
 
 func (dal *DALCache) Refresh() {
 	dal.logger.Info("refreshing-cache")
 
-	buckets, _, err := dal.fetchBucketList()
+	dal.syncLock.Lock()
+	defer dal.syncLock.Unlock()
+
+	buckets, isModified, err := dal.syncBucketList()
 	if err != nil {
 		dal.logger.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("refreshing-cache-failed")
 		return
 	}
-	dal.Buckets = buckets
+	if atomic.CompareAndSwapInt32(&dal.isStale, 1, 0) {
+		dal.logger.Info("synced-bucket-list-after-backup")
+	}
+	if !isModified {
+		dal.logger.Debug("bucket-list-not-modified")
+		return
+	}
 
-	dal.FileCache.Invalidate(buckets)
+	dal.applyBuckets(buckets)
 	return
 }
 
-func (dal *DALCache) fetchBucketList() ([]*model.Bucket, *resty.Response, error) {
-	var response GetBucketListResponse
-	resp, err := dal.HTTPClient.R().
-		SetResult(&response).
-		Get(dal.apiURL + "/buckets")
+// UpdateBucket merges the bucket into the buckets without waiting for the next refresh. The updates with older
+// revisions than the current bucket are rejected with dal.ErrorBucketOutdated.
+func (dal *DALCache) UpdateBucket(id string, bucket *model.Bucket) error {
+	dal.syncLock.Lock()
+	defer dal.syncLock.Unlock()
+
+	if bucket == nil {
+		var err error
+		bucket, err = dal.fetchBucket(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	var buckets []*model.Bucket
+	if bucket == nil {
+		buckets = mergeBucketLists(dal.Buckets, nil, []string{id})
+	} else {
+		if err := assertNotOutdated(dal.Buckets, bucket); err != nil {
+			dal.logger.WithFields(logrus.Fields{
+				"id":       id,
+				"revision": bucket.Revision,
+			}).Warn("ignored-outdated-bucket-update")
+			return err
+		}
+		buckets = mergeBucketLists(dal.Buckets, []*model.Bucket{bucket}, nil)
+	}
 
 	dal.logger.WithFields(logrus.Fields{
-		"bucketCount": len(response.Results),
-		"status":      resp.Status(),
-	}).Info("retrieved-bucket-list")
+		"id":      id,
+		"removed": bucket == nil,
+	}).Info("updating-bucket")
+
+	dal.applyBuckets(buckets)
+	return nil
+}
+
+// GetBuckets returns the current buckets. The buckets are read under the sync lock since they are replaced
+// by the refreshes and the webhook updates.
+func (dal *DALCache) GetBuckets() []*model.Bucket {
+	dal.syncLock.Lock()
+	defer dal.syncLock.Unlock()
+	return dal.Buckets
+}
+
+// applyBuckets replaces the buckets and invalidates the cached files of the changed ones.
+// The sync lock must be held by the caller.
+func (dal *DALCache) applyBuckets(buckets []*model.Bucket) {
+	previousBuckets := dal.Buckets
+	dal.setBuckets(buckets)
+	dal.saveBackup(buckets)
+
+	dal.FileCache.SetQuotas(buckets)
+	dal.invalidateChangedBuckets(previousBuckets, buckets)
+}
+
+// invalidateChangedBuckets purges the cached files of the buckets that are changed or removed. The cache is not
+// touched if none of the buckets is changed.
+func (dal *DALCache) invalidateChangedBuckets(previous, current []*model.Bucket) {
+	diff := diffBucketLists(previous, current)
+
+	purged := cache.PurgeResult{}
+	for _, changes := range [][]bucketChange{diff.changed, diff.removed} {
+		for _, change := range changes {
+			prefixes := change.getPrefixesToInvalidate()
+			for _, prefix := range prefixes {
+				purged = purged.Add(dal.FileCache.Purge(prefix, true))
+			}
+
+			bucket := change.current
+			if bucket == nil {
+				bucket = change.previous
+			}
+			dal.logger.WithFields(logrus.Fields{
+				"domain":   core.StringValue(bucket.Domain),
+				"folder":   core.StringValue(bucket.Folder),
+				"fields":   change.fields,
+				"removed":  change.current == nil,
+				"prefixes": prefixes,
+			}).Info("bucket-changed")
+		}
+	}
+
+	dal.logger.WithFields(logrus.Fields{
+		"added":         len(diff.added),
+		"removed":       len(diff.removed),
+		"changed":       len(diff.changed),
+		"unchanged":     diff.unchanged,
+		"purgedEntries": purged.Entries,
+		"purgedBytes":   purged.Bytes,
+	}).Info("invalidated-changed-buckets")
+}
+
+// setBuckets replaces the buckets and their index
+func (dal *DALCache) setBuckets(buckets []*model.Bucket) {
+	index, duplicates := newBucketIndex(buckets)
+	if len(duplicates) > 0 {
+		dal.logger.WithFields(logrus.Fields{
+			"hosts": duplicates,
+		}).Warn("hosts-used-by-more-than-one-bucket")
+	}
+
+	dal.Buckets = buckets
+	dal.index.Store(index)
+}
 
-	return response.Results, resp, err
+// getIndex returns the index of the current buckets
+func (dal *DALCache) getIndex() *bucketIndex {
+	return dal.index.Load().(*bucketIndex)
 }
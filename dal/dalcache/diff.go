@@ -0,0 +1,126 @@
+package dalcache
+
+import (
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/model"
+)
+
+// bucketChange is a bucket that's changed, added or removed between two bucket lists
+type bucketChange struct {
+	// previous is nil for the added buckets and current is nil for the removed buckets
+	previous *model.Bucket
+	current  *model.Bucket
+
+	// fields are the names of the changed fields that affect the cached files
+	fields []string
+}
+
+// bucketListDiff contains the changes between two bucket lists
+type bucketListDiff struct {
+	added     []bucketChange
+	removed   []bucketChange
+	changed   []bucketChange
+	unchanged int
+}
+
+// diffBucketLists compares the buckets in the lists by their IDs
+func diffBucketLists(previous, current []*model.Bucket) bucketListDiff {
+	previousBuckets := map[string]*model.Bucket{}
+	for _, bucket := range previous {
+		previousBuckets[getBucketKey(bucket)] = bucket
+	}
+
+	diff := bucketListDiff{}
+	for _, bucket := range current {
+		key := getBucketKey(bucket)
+		previousBucket, exists := previousBuckets[key]
+		if !exists {
+			diff.added = append(diff.added, bucketChange{current: bucket})
+			continue
+		}
+		delete(previousBuckets, key)
+
+		fields := getChangedFields(previousBucket, bucket)
+		if len(fields) == 0 {
+			diff.unchanged++
+			continue
+		}
+		diff.changed = append(diff.changed, bucketChange{previous: previousBucket, current: bucket, fields: fields})
+	}
+
+	for _, bucket := range previous {
+		if _, exists := previousBuckets[getBucketKey(bucket)]; exists {
+			diff.removed = append(diff.removed, bucketChange{previous: bucket})
+		}
+	}
+	return diff
+}
+
+// getPrefixesToInvalidate returns the path prefixes of the cached files that can't be served anymore after the
+// change. The added buckets don't have cached files.
+func (change bucketChange) getPrefixesToInvalidate() []string {
+	if change.previous == nil {
+		return nil
+	}
+
+	folderPrefix := core.StringValue(change.previous.Folder) + "/"
+	versionPrefix := folderPrefix + core.StringValue(change.previous.Version) + "/"
+	isPathVersioned := core.StringValue(change.previous.VersionIdentifier) == "path"
+	if change.current == nil {
+		return []string{folderPrefix}
+	}
+
+	isVersionChanged := false
+	for _, field := range change.fields {
+		switch field {
+		case "folder", "status", "isCacheEnabled", "versionIdentifier":
+			// none of the cached files of the bucket can be served anymore
+			return []string{folderPrefix}
+		case "version":
+			isVersionChanged = true
+		}
+	}
+
+	if isPathVersioned {
+		if isVersionChanged {
+			// the files of the previous versions are still served since the version is in the request path
+			return nil
+		}
+		// only the revision is changed, the files may be uploaded again to any version
+		return []string{folderPrefix}
+	}
+	// the files of the previous version are not served anymore or they may be uploaded again
+	return []string{versionPrefix}
+}
+
+// getChangedFields returns the names of the fields that affect the cached files
+func getChangedFields(previous, current *model.Bucket) []string {
+	fields := make([]string, 0)
+	if core.StringValue(previous.Version) != core.StringValue(current.Version) {
+		fields = append(fields, "version")
+	}
+	if core.StringValue(previous.Folder) != core.StringValue(current.Folder) {
+		fields = append(fields, "folder")
+	}
+	if core.StringValue(previous.Status) != core.StringValue(current.Status) {
+		fields = append(fields, "status")
+	}
+	if core.BoolValue(previous.IsCacheEnabled) != core.BoolValue(current.IsCacheEnabled) {
+		fields = append(fields, "isCacheEnabled")
+	}
+	if core.StringValue(previous.VersionIdentifier) != core.StringValue(current.VersionIdentifier) {
+		fields = append(fields, "versionIdentifier")
+	}
+	if previous.Revision != current.Revision {
+		fields = append(fields, "revision")
+	}
+	return fields
+}
+
+// getBucketKey returns the ID of the bucket or its folder if the ID is not returned by the API
+func getBucketKey(bucket *model.Bucket) string {
+	if bucket.ID.IsZero() {
+		return "folder:" + core.StringValue(bucket.Folder)
+	}
+	return bucket.ID.Hex()
+}
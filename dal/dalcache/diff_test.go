@@ -0,0 +1,66 @@
+package dalcache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func newTestBucket(folder, version, versionIdentifier string) *model.Bucket {
+	return &model.Bucket{
+		ID:                primitive.NewObjectID(),
+		Folder:            aws.String(folder),
+		Version:           aws.String(version),
+		VersionIdentifier: aws.String(versionIdentifier),
+		Status:            aws.String("active"),
+		IsCacheEnabled:    aws.Bool(true),
+		Revision:          1,
+	}
+}
+
+func TestDiffBucketLists(t *testing.T) {
+	unchanged := newTestBucket("a1b2c3", "0.0.1", "header")
+	removed := newTestBucket("d4e5f6", "0.0.1", "header")
+	versioned := newTestBucket("g7h8i9", "0.0.1", "header")
+	added := newTestBucket("j1k2l3", "0.0.1", "header")
+
+	versionedCopy := *versioned
+	versionedCopy.Version = aws.String("0.0.2")
+	versionedCopy.Revision = 2
+
+	diff := diffBucketLists(
+		[]*model.Bucket{unchanged, removed, versioned},
+		[]*model.Bucket{unchanged, &versionedCopy, added},
+	)
+
+	assert.Equal(t, 1, diff.unchanged, "incorrect unchanged bucket count")
+	assert.Equal(t, []bucketChange{{current: added}}, diff.added, "incorrect added buckets")
+	assert.Equal(t, []bucketChange{{previous: removed}}, diff.removed, "incorrect removed buckets")
+	assert.Equal(t, 1, len(diff.changed), "incorrect changed bucket count")
+	assert.Equal(t, []string{"version", "revision"}, diff.changed[0].fields, "incorrect changed fields")
+
+	assert.Equal(t, []string{"d4e5f6/"}, diff.removed[0].getPrefixesToInvalidate(), "files of removed bucket must be invalidated")
+	assert.Equal(t, []string{"g7h8i9/0.0.1/"}, diff.changed[0].getPrefixesToInvalidate(), "files of previous version must be invalidated")
+	assert.Nil(t, diff.added[0].getPrefixesToInvalidate(), "added bucket must not have files to invalidate")
+}
+
+func TestGetPrefixesToInvalidate(t *testing.T) {
+	previous := newTestBucket("a1b2c3", "0.0.1", "path")
+
+	current := *previous
+	current.Version = aws.String("0.0.2")
+	change := bucketChange{previous: previous, current: &current, fields: getChangedFields(previous, &current)}
+	assert.Nil(t, change.getPrefixesToInvalidate(), "files of previous versions must be kept when version is in path")
+
+	current = *previous
+	current.Revision = 2
+	change = bucketChange{previous: previous, current: &current, fields: getChangedFields(previous, &current)}
+	assert.Equal(t, []string{"a1b2c3/"}, change.getPrefixesToInvalidate(), "files of all versions must be invalidated on update")
+
+	current = *previous
+	current.IsCacheEnabled = aws.Bool(false)
+	change = bucketChange{previous: previous, current: &current, fields: getChangedFields(previous, &current)}
+	assert.Equal(t, []string{"a1b2c3/"}, change.getPrefixesToInvalidate(), "all files must be invalidated when caching is disabled")
+}
@@ -4,4 +4,11 @@ import "github.com/devingen/sepet-cdn/model"
 
 type GetBucketListResponse struct {
 	Results []*model.Bucket `json:"results"`
+
+	// IsPartial is true if only the buckets updated since the requested time are returned. The APIs that don't
+	// support the incremental sync return all the buckets.
+	IsPartial bool `json:"partial,omitempty"`
+
+	// RemovedIDs are the IDs of the buckets removed since the requested time in the partial responses
+	RemovedIDs []string `json:"removed,omitempty"`
 }
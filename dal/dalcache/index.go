@@ -0,0 +1,121 @@
+package dalcache
+
+import (
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/devingen/sepet-cdn/model"
+	"net"
+	"strings"
+)
+
+// bucketIndex maps the hosts and the domains to the buckets
+type bucketIndex struct {
+	// hosts maps the custom hostnames to the buckets
+	hosts map[string]*model.Bucket
+
+	// domains maps the domains and the aliases to the buckets
+	domains map[string]*model.Bucket
+}
+
+// newBucketIndex builds the index of the buckets. The first bucket in the list is used if a host or a domain is
+// used by more than one bucket and the duplicate hosts and domains are returned.
+func newBucketIndex(buckets []*model.Bucket) (*bucketIndex, []string) {
+	index := &bucketIndex{
+		hosts:   map[string]*model.Bucket{},
+		domains: map[string]*model.Bucket{},
+	}
+
+	duplicates := make([]string, 0)
+	add := func(names map[string]*model.Bucket, name string, bucket *model.Bucket) {
+		name = normalizeHost(name)
+		if name == "" {
+			return
+		}
+		if existing, exists := names[name]; exists {
+			if existing != bucket {
+				duplicates = append(duplicates, name)
+			}
+			return
+		}
+		names[name] = bucket
+	}
+
+	for _, bucket := range buckets {
+		add(index.domains, core.StringValue(bucket.Domain), bucket)
+		if bucket.Aliases != nil {
+			for _, alias := range *bucket.Aliases {
+				add(index.domains, alias, bucket)
+			}
+		}
+		if bucket.Hostnames != nil {
+			for _, hostname := range *bucket.Hostnames {
+				add(index.hosts, hostname, bucket)
+			}
+		}
+	}
+	return index, duplicates
+}
+
+// getByHost returns the bucket of the custom hostname. The subdomain of the host under the root domains is
+// looked up in the domains if there is no bucket with the hostname. The root domains must be normalized.
+func (index *bucketIndex) getByHost(host string, rootDomains []string) (*model.Bucket, error) {
+	hostname := normalizeHost(getHostname(host))
+	if bucket, exists := index.hosts[hostname]; exists {
+		return bucket, nil
+	}
+
+	subdomain, isUnderRootDomain := getSubdomain(hostname, rootDomains)
+	if !isUnderRootDomain {
+		return nil, dal.ErrorHostNotServed
+	}
+
+	bucket, exists := index.domains[subdomain]
+	if !exists {
+		return nil, dal.ErrorBucketNotFound
+	}
+	return bucket, nil
+}
+
+// getHostname returns the host without the port and the brackets of the IPv6 literals.
+// Returns "::1" for "[::1]:8080".
+func getHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// getSubdomain returns the part of the hostname before the longest root domain that it's under. Returns "acme"
+// for "acme.sepet.devingen.io" if "sepet.devingen.io" is a root domain. The first label of the hostname is
+// returned if there are no root domains.
+func getSubdomain(hostname string, rootDomains []string) (string, bool) {
+	if len(rootDomains) == 0 {
+		dotIndex := strings.IndexByte(hostname, '.')
+		if dotIndex < 0 {
+			return hostname, true
+		}
+		return hostname[:dotIndex], true
+	}
+
+	if net.ParseIP(hostname) != nil {
+		// the IP addresses don't have subdomains
+		return "", false
+	}
+
+	subdomain := ""
+	for _, rootDomain := range rootDomains {
+		suffix := "." + rootDomain
+		if !strings.HasSuffix(hostname, suffix) || len(hostname) == len(suffix) {
+			continue
+		}
+		if candidate := strings.TrimSuffix(hostname, suffix); subdomain == "" || len(candidate) < len(subdomain) {
+			subdomain = candidate
+		}
+	}
+	return subdomain, subdomain != ""
+}
+
+// normalizeHost returns the host in lower case without the trailing dot of the fully qualified domain names
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
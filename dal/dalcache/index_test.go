@@ -0,0 +1,94 @@
+package dalcache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGetHostname(t *testing.T) {
+	assert.Equal(t, "acme.sepet.devingen.io", getHostname("acme.sepet.devingen.io"), "incorrect hostname")
+	assert.Equal(t, "acme.sepet.devingen.io", getHostname("acme.sepet.devingen.io:8080"), "port must be removed")
+	assert.Equal(t, "::1", getHostname("[::1]:8080"), "port and brackets of IPv6 must be removed")
+	assert.Equal(t, "::1", getHostname("[::1]"), "brackets of IPv6 must be removed")
+	assert.Equal(t, "::1", getHostname("::1"), "IPv6 without brackets must be kept")
+}
+
+func TestGetSubdomain(t *testing.T) {
+	rootDomains := []string{"devingen.io", "sepet.devingen.io", "cdn.acme.net"}
+
+	subdomain, isUnderRootDomain := getSubdomain("acme.sepet.devingen.io", nil)
+	assert.Equal(t, "acme", subdomain, "first label must be used without root domains")
+	assert.True(t, isUnderRootDomain)
+
+	subdomain, _ = getSubdomain("localhost", nil)
+	assert.Equal(t, "localhost", subdomain, "host must be used if it doesn't have labels")
+
+	subdomain, isUnderRootDomain = getSubdomain("acme.sepet.devingen.io", rootDomains)
+	assert.Equal(t, "acme", subdomain, "longest root domain must be removed")
+	assert.True(t, isUnderRootDomain)
+
+	subdomain, _ = getSubdomain("acme.cdn.acme.net", rootDomains)
+	assert.Equal(t, "acme", subdomain, "root domain must be removed")
+
+	_, isUnderRootDomain = getSubdomain("evil.example.org", rootDomains)
+	assert.False(t, isUnderRootDomain, "host must not be under the root domains")
+
+	_, isUnderRootDomain = getSubdomain("evilsepet.devingen.io.example.org", rootDomains)
+	assert.False(t, isUnderRootDomain, "root domain must be the suffix of the host")
+
+	_, isUnderRootDomain = getSubdomain("cdn.acme.net", rootDomains)
+	assert.False(t, isUnderRootDomain, "root domain must not have a subdomain")
+
+	_, isUnderRootDomain = getSubdomain("127.0.0.1", rootDomains)
+	assert.False(t, isUnderRootDomain, "IP address must not have a subdomain")
+}
+
+func TestGetBucketByHost(t *testing.T) {
+	rootDomains := []string{"sepet.devingen.io"}
+	acme := &model.Bucket{
+		Domain:    aws.String("acme"),
+		Aliases:   &[]string{"acme-app"},
+		Hostnames: &[]string{"www.acme.com", "Acme.com"},
+	}
+	other := &model.Bucket{
+		Domain:    aws.String("other"),
+		Hostnames: &[]string{"www.acme.com", "other.sepet.devingen.io"},
+	}
+	wwwBucket := &model.Bucket{
+		Domain: aws.String("www"),
+	}
+
+	index, duplicates := newBucketIndex([]*model.Bucket{acme, other, wwwBucket})
+	assert.Equal(t, []string{"www.acme.com"}, duplicates, "incorrect duplicate hosts")
+
+	bucket, err := index.getByHost("www.acme.com", rootDomains)
+	assert.Nil(t, err)
+	assert.Equal(t, acme, bucket, "custom hostname must be resolved")
+
+	bucket, _ = index.getByHost("acme.com.:443", rootDomains)
+	assert.Equal(t, acme, bucket, "hostnames must be case insensitive and resolved without port")
+
+	bucket, _ = index.getByHost("acme.sepet.devingen.io:8080", rootDomains)
+	assert.Equal(t, acme, bucket, "domain must be resolved")
+
+	bucket, _ = index.getByHost("acme-app.sepet.devingen.io", rootDomains)
+	assert.Equal(t, acme, bucket, "alias must be resolved")
+
+	bucket, _ = index.getByHost("other.sepet.devingen.io", rootDomains)
+	assert.Equal(t, other, bucket, "exact host must be resolved first")
+
+	_, err = index.getByHost("unknown.sepet.devingen.io", rootDomains)
+	assert.Equal(t, dal.ErrorBucketNotFound, err, "unknown domain must not be resolved")
+
+	_, err = index.getByHost("www.unknown.com", rootDomains)
+	assert.Equal(t, dal.ErrorHostNotServed, err, "host out of root domains must not be served")
+
+	// the first label is the domain without the root domains like before the custom hostnames
+	bucket, _ = index.getByHost("www.unknown.com", nil)
+	assert.Equal(t, wwwBucket, bucket, "first label must be resolved")
+	bucket, _ = index.getByHost("www.acme.com", nil)
+	assert.Equal(t, acme, bucket, "custom hostname must be resolved first")
+}
@@ -0,0 +1,192 @@
+package dalcache
+
+import (
+	"fmt"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// fullSyncInterval is how often the whole bucket list is fetched while syncing incrementally. The full sync
+// removes the buckets that the API doesn't report as removed in the incremental responses.
+const fullSyncInterval = time.Hour
+
+// updatedSinceParam is the query parameter of the bucket list request to get only the buckets updated after the time
+const updatedSinceParam = "updatedSince"
+
+// syncState keeps what's known about the last bucket list sync to make the next one conditional or incremental
+type syncState struct {
+	// eTag and lastModified are the headers of the last full bucket list response
+	eTag         string
+	lastModified string
+
+	// updatedSince is the latest update time of the synced buckets
+	updatedSince time.Time
+
+	// lastFullSyncAt is the time of the last full bucket list response
+	lastFullSyncAt time.Time
+
+	// isIncrementalUnsupported is true if the API returned all the buckets for an incremental request
+	isIncrementalUnsupported bool
+}
+
+// syncBucketList gets the changes in the bucket list since the last sync. The whole list is requested
+// conditionally and it's not returned if it's not modified. Only the updated buckets are requested if the API
+// supports it and they're merged into the current buckets. Returns false if the buckets are not changed.
+func (dal *DALCache) syncBucketList() ([]*model.Bucket, bool, error) {
+	isIncremental := !dal.lastSync.isIncrementalUnsupported &&
+		!dal.lastSync.updatedSince.IsZero() &&
+		time.Since(dal.lastSync.lastFullSyncAt) < fullSyncInterval
+
+	request := dal.HTTPClient.R()
+	if isIncremental {
+		request.SetQueryParam(updatedSinceParam, dal.lastSync.updatedSince.Format(time.RFC3339Nano))
+	} else {
+		if dal.lastSync.eTag != "" {
+			request.SetHeader("If-None-Match", dal.lastSync.eTag)
+		}
+		if dal.lastSync.lastModified != "" {
+			request.SetHeader("If-Modified-Since", dal.lastSync.lastModified)
+		}
+	}
+
+	response, resp, err := dal.fetchBucketList(request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if resp.StatusCode() == http.StatusNotModified {
+		dal.lastSync.lastFullSyncAt = time.Now()
+		return nil, false, nil
+	}
+
+	if isIncremental && !response.IsPartial {
+		// the API ignored the parameter and returned all the buckets, the next syncs are made with the full list
+		dal.logger.Info("incremental-bucket-list-sync-not-supported")
+		dal.lastSync.isIncrementalUnsupported = true
+	}
+
+	var buckets []*model.Bucket
+	if response.IsPartial {
+		if len(response.Results) == 0 && len(response.RemovedIDs) == 0 {
+			return nil, false, nil
+		}
+		buckets = mergeBucketLists(dal.Buckets, response.Results, response.RemovedIDs)
+	} else {
+		buckets = response.Results
+		dal.lastSync.eTag = resp.Header().Get("ETag")
+		dal.lastSync.lastModified = resp.Header().Get("Last-Modified")
+		dal.lastSync.lastFullSyncAt = time.Now()
+	}
+	dal.lastSync.updatedSince = getLatestUpdate(buckets)
+	return buckets, true, nil
+}
+
+func (dal *DALCache) fetchBucketList(request *resty.Request) (*GetBucketListResponse, *resty.Response, error) {
+	var response GetBucketListResponse
+	resp, err := request.
+		SetResult(&response).
+		Get(dal.apiURL + "/buckets")
+
+	dal.logger.WithFields(logrus.Fields{
+		"bucketCount":  len(response.Results),
+		"removedCount": len(response.RemovedIDs),
+		"partial":      response.IsPartial,
+		"status":       resp.Status(),
+	}).Info("retrieved-bucket-list")
+
+	if err != nil {
+		return nil, resp, err
+	}
+	if resp.StatusCode() != http.StatusNotModified && resp.IsError() {
+		return nil, resp, fmt.Errorf("bucket-list-responded-with-status-%d", resp.StatusCode())
+	}
+	return &response, resp, nil
+}
+
+// fetchBucket gets the bucket with the ID from the API. Returns nil if the bucket is not found.
+func (dal *DALCache) fetchBucket(id string) (*model.Bucket, error) {
+	var bucket model.Bucket
+	resp, err := dal.HTTPClient.R().
+		SetResult(&bucket).
+		Get(dal.apiURL + "/buckets/" + url.PathEscape(id))
+
+	dal.logger.WithFields(logrus.Fields{
+		"id":     id,
+		"status": resp.Status(),
+	}).Info("retrieved-bucket")
+
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("bucket-responded-with-status-%d", resp.StatusCode())
+	}
+	return &bucket, nil
+}
+
+// mergeBucketLists returns the buckets with the updated ones replaced or added and the removed ones excluded.
+// The updates with older revisions than the current buckets are ignored.
+func mergeBucketLists(buckets, updated []*model.Bucket, removedIDs []string) []*model.Bucket {
+	updatedBuckets := map[string]*model.Bucket{}
+	for _, bucket := range updated {
+		updatedBuckets[getBucketKey(bucket)] = bucket
+	}
+	removed := map[string]bool{}
+	for _, id := range removedIDs {
+		removed[id] = true
+	}
+
+	merged := make([]*model.Bucket, 0, len(buckets)+len(updated))
+	for _, bucket := range buckets {
+		key := getBucketKey(bucket)
+		if removed[key] {
+			continue
+		}
+		if updatedBucket, exists := updatedBuckets[key]; exists {
+			delete(updatedBuckets, key)
+			if updatedBucket.Revision >= bucket.Revision {
+				bucket = updatedBucket
+			}
+		}
+		merged = append(merged, bucket)
+	}
+
+	// the new buckets are added in the order of the response
+	for _, bucket := range updated {
+		key := getBucketKey(bucket)
+		if _, isNew := updatedBuckets[key]; isNew && !removed[key] {
+			merged = append(merged, bucket)
+		}
+	}
+	return merged
+}
+
+// assertNotOutdated returns dal.ErrorBucketOutdated if the buckets have the bucket with a newer revision
+func assertNotOutdated(buckets []*model.Bucket, bucket *model.Bucket) error {
+	key := getBucketKey(bucket)
+	for _, current := range buckets {
+		if getBucketKey(current) == key && bucket.Revision < current.Revision {
+			return dal.ErrorBucketOutdated
+		}
+	}
+	return nil
+}
+
+// getLatestUpdate returns the latest update time of the buckets
+func getLatestUpdate(buckets []*model.Bucket) time.Time {
+	latest := time.Time{}
+	for _, bucket := range buckets {
+		if bucket.UpdatedAt != nil && bucket.UpdatedAt.After(latest) {
+			latest = *bucket.UpdatedAt
+		}
+	}
+	return latest
+}
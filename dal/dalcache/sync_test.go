@@ -0,0 +1,143 @@
+package dalcache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/config"
+	"github.com/devingen/sepet-cdn/model"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMergeBucketLists(t *testing.T) {
+	unchanged := newTestBucket("a1b2c3", "0.0.1", "header")
+	removed := newTestBucket("d4e5f6", "0.0.1", "header")
+	updated := newTestBucket("g7h8i9", "0.0.1", "header")
+	outdated := newTestBucket("j1k2l3", "0.0.1", "header")
+	added := newTestBucket("m4n5o6", "0.0.1", "header")
+
+	updatedCopy := *updated
+	updatedCopy.Revision = 2
+	outdatedCopy := *outdated
+	outdatedCopy.Revision = 0
+
+	merged := mergeBucketLists(
+		[]*model.Bucket{unchanged, removed, updated, outdated},
+		[]*model.Bucket{&updatedCopy, &outdatedCopy, added},
+		[]string{removed.ID.Hex()},
+	)
+	assert.Equal(t, []*model.Bucket{unchanged, &updatedCopy, outdated, added}, merged, "incorrect merged buckets")
+}
+
+func TestSyncsBucketListConditionallyAndIncrementally(t *testing.T) {
+	firstUpdate := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	acme := newTestBucket("a1b2c3", "0.0.1", "header")
+	acme.Domain = aws.String("acme")
+	acme.UpdatedAt = &firstUpdate
+
+	requests := make([]*http.Request, 0)
+	var response GetBucketListResponse
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Header.Get("If-None-Match") == `"list"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"list"`)
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer api.Close()
+
+	fileCache, err := filemapcache.New(log.WithLogger(context.Background(), logrus.New()), config.Cache{ResetInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first sync gets the whole list
+	response = GetBucketListResponse{Results: []*model.Bucket{acme}}
+	dal, err := New(log.WithLogger(context.Background(), logrus.New()), fileCache, api.URL, "", nil, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dal.Close()
+	assert.Equal(t, acme, dal.GetBucket("acme"), "bucket must be loaded")
+	assert.Equal(t, "", requests[0].URL.Query().Get(updatedSinceParam), "first sync must not be incremental")
+
+	// the next sync gets only the updated buckets
+	secondUpdate := firstUpdate.Add(time.Minute)
+	other := newTestBucket("d4e5f6", "0.0.1", "header")
+	other.Domain = aws.String("other")
+	other.UpdatedAt = &secondUpdate
+	response = GetBucketListResponse{Results: []*model.Bucket{other}, IsPartial: true}
+	dal.Refresh()
+	assert.Equal(t, firstUpdate.Format(time.RFC3339Nano), requests[1].URL.Query().Get(updatedSinceParam), "incorrect updated since")
+	assert.Equal(t, acme.ID, dal.GetBucket("acme").ID, "existing bucket must be kept")
+	assert.Equal(t, other.ID, dal.GetBucket("other").ID, "updated bucket must be merged")
+
+	// the whole list is requested conditionally if the API doesn't support the incremental sync
+	response = GetBucketListResponse{Results: []*model.Bucket{acme, other}}
+	dal.Refresh()
+	assert.Equal(t, secondUpdate.Format(time.RFC3339Nano), requests[2].URL.Query().Get(updatedSinceParam), "incorrect updated since")
+	assert.True(t, dal.lastSync.isIncrementalUnsupported, "incremental sync must be disabled")
+
+	buckets := dal.Buckets
+	dal.Refresh()
+	assert.Equal(t, "", requests[3].URL.Query().Get(updatedSinceParam), "sync must not be incremental")
+	assert.Equal(t, `"list"`, requests[3].Header.Get("If-None-Match"), "sync must be conditional")
+	assert.Equal(t, buckets, dal.Buckets, "buckets must not be replaced if the list is not modified")
+}
+
+func TestUpdatesBucketWithoutRefresh(t *testing.T) {
+	acme := newTestBucket("a1b2c3", "0.0.1", "header")
+	acme.Domain = aws.String("acme")
+	other := newTestBucket("d4e5f6", "0.0.1", "header")
+	other.Domain = aws.String("other")
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/buckets" {
+			// the buckets are removed from the API after the list is fetched
+			http.Error(w, "not-found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetBucketListResponse{Results: []*model.Bucket{acme, other}})
+	}))
+	defer api.Close()
+
+	fileCache, err := filemapcache.New(log.WithLogger(context.Background(), logrus.New()), config.Cache{ResetInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileCache.SaveFile("a1b2c3/0.0.1/index.html", &s3.GetObjectOutput{}, []byte("index"))
+	fileCache.SaveFile("d4e5f6/0.0.1/index.html", &s3.GetObjectOutput{}, []byte("other"))
+
+	dal, err := New(log.WithLogger(context.Background(), logrus.New()), fileCache, api.URL, "", nil, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dal.Close()
+
+	// the version flip invalidates the files of the previous version
+	acmeCopy := *acme
+	acmeCopy.Version = aws.String("0.0.2")
+	acmeCopy.Revision = 2
+	assert.Nil(t, dal.UpdateBucket(acme.ID.Hex(), &acmeCopy))
+	assert.Equal(t, "0.0.2", *dal.GetBucket("acme").Version, "bucket must be updated")
+	_, _, hasPreviousVersion := fileCache.GetFile("a1b2c3/0.0.1/index.html")
+	assert.False(t, hasPreviousVersion, "files of the previous version must be invalidated")
+
+	// the bucket that the API doesn't have anymore is removed
+	assert.Nil(t, dal.UpdateBucket(other.ID.Hex(), nil))
+	assert.Nil(t, dal.GetBucket("other"), "bucket must be removed")
+	_, _, hasRemovedBucket := fileCache.GetFile("d4e5f6/0.0.1/index.html")
+	assert.False(t, hasRemovedBucket, "files of the removed bucket must be invalidated")
+}
@@ -0,0 +1,41 @@
+package daltest
+
+import (
+	core "github.com/devingen/api-core"
+	"github.com/devingen/sepet-cdn/dal"
+	"github.com/devingen/sepet-cdn/model"
+)
+
+// DAL implements DAL interface with a single bucket to be used in the tests
+type DAL struct {
+	// Bucket is returned for its domain, or for all the domains if MatchesAnyDomain is true
+	Bucket           *model.Bucket
+	MatchesAnyDomain bool
+
+	// Stale is returned by IsStale
+	Stale bool
+}
+
+func (d *DAL) GetBucket(domain string) *model.Bucket {
+	if d.Bucket != nil && (d.MatchesAnyDomain || core.StringValue(d.Bucket.Domain) == domain) {
+		return d.Bucket
+	}
+	return nil
+}
+
+func (d *DAL) GetBucketByHost(host string) (*model.Bucket, error) {
+	if bucket := d.GetBucket(host); bucket != nil {
+		return bucket, nil
+	}
+	return nil, dal.ErrorBucketNotFound
+}
+
+func (d *DAL) UpdateBucket(id string, bucket *model.Bucket) error {
+	return nil
+}
+
+func (d *DAL) IsStale() bool {
+	return d.Stale
+}
+
+func (d *DAL) Refresh() {}
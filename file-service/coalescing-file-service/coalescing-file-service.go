@@ -0,0 +1,124 @@
+package coalescingfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	"sync"
+)
+
+// errFetchPanicked is returned to the callers waiting for a fetch that panicked
+var errFetchPanicked = errors.New("fetch-panicked")
+
+// CoalescingService implements IFileService interface by sharing a single fetch of the underlying file
+// service between the concurrent requests of the same file. The errors like ErrorFileNotFound are
+// shared as well. The open Body of a file that's too large is returned only to the caller that
+// made the fetch since it can be read once. The fetch is made with the context of the caller that
+// started it, so it's made again for the waiting callers if that caller's context is done.
+type CoalescingService struct {
+	FileService fs.IFileService
+
+	// lock guards the calls
+	lock sync.Mutex
+
+	// calls keeps the fetches in progress by their keys
+	calls map[string]*call
+}
+
+// call is a fetch in progress or completed
+type call struct {
+	wg      sync.WaitGroup
+	meta    *s3.GetObjectOutput
+	content []byte
+	err     error
+
+	// waiters is the number of the callers waiting for the fetch. It's guarded by the lock of the service.
+	waiters int
+}
+
+// New generates new CoalescingService
+func New(fileService fs.IFileService) *CoalescingService {
+	return &CoalescingService{
+		FileService: fileService,
+		calls:       map[string]*call{},
+	}
+}
+
+// GetFile implements IFileService interface
+func (cs *CoalescingService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	return cs.do(ctx, filePath, func() (*s3.GetObjectOutput, []byte, error) {
+		return cs.FileService.GetFile(ctx, filePath)
+	})
+}
+
+// GetFileIfModified implements IFileService interface. The fetches are shared only if they are
+// made for the same ETag.
+func (cs *CoalescingService) GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	key := filePath + "?if-none-match=" + aws.StringValue(knownMeta.ETag)
+	return cs.do(ctx, key, func() (*s3.GetObjectOutput, []byte, error) {
+		return cs.FileService.GetFileIfModified(ctx, filePath, knownMeta)
+	})
+}
+
+// GetFileStream implements IFileService interface. The streams are not shared since their bodies
+// can be read only once.
+func (cs *CoalescingService) GetFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*s3.GetObjectOutput, error) {
+	return cs.FileService.GetFileStream(ctx, filePath, fileRange)
+}
+
+// GetFilePart implements IFileService interface. The fetches are shared only if they are made for the same
+// range and ETag.
+func (cs *CoalescingService) GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error) {
+	key := fmt.Sprintf("%s?range=%d-%d&if-match=%s", filePath, start, end, eTag)
+	return cs.do(ctx, key, func() (*s3.GetObjectOutput, []byte, error) {
+		return cs.FileService.GetFilePart(ctx, filePath, start, end, eTag)
+	})
+}
+
+// do runs the fetch if there is no fetch in progress for the key. Otherwise, waits for the fetch
+// in progress and returns its result.
+func (cs *CoalescingService) do(ctx context.Context, key string, fetch func() (*s3.GetObjectOutput, []byte, error)) (*s3.GetObjectOutput, []byte, error) {
+	cs.lock.Lock()
+	if c, exists := cs.calls[key]; exists {
+		// wait for the fetch in progress
+		c.waiters++
+		cs.lock.Unlock()
+		c.wg.Wait()
+		if (c.err == context.Canceled || c.err == context.DeadlineExceeded) && ctx.Err() == nil {
+			// the caller that made the fetch is gone, this caller still needs the file
+			return cs.do(ctx, key, fetch)
+		}
+		if c.meta != nil && c.meta.Body != nil {
+			metaCopy := *c.meta
+			metaCopy.Body = nil
+			return &metaCopy, c.content, c.err
+		}
+		return c.meta, c.content, c.err
+	}
+
+	c := &call{}
+	c.wg.Add(1)
+	cs.calls[key] = c
+	cs.lock.Unlock()
+
+	// the waiters are released even if the fetch panics
+	isCompleted := false
+	defer func() {
+		if !isCompleted {
+			c.err = errFetchPanicked
+		}
+
+		// the call is removed first to let the waiters start a new fetch if they need
+		cs.lock.Lock()
+		delete(cs.calls, key)
+		cs.lock.Unlock()
+		c.wg.Done()
+	}()
+
+	c.meta, c.content, c.err = fetch()
+	isCompleted = true
+	return c.meta, c.content, c.err
+}
@@ -0,0 +1,163 @@
+package coalescingfs
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/s3"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingService returns ErrorFileNotFound for all the files after the release channel is closed
+type blockingService struct {
+	fetchCount int32
+	release    chan struct{}
+}
+
+func (bs *blockingService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	atomic.AddInt32(&bs.fetchCount, 1)
+	<-bs.release
+	return nil, nil, fs.ErrorFileNotFound
+}
+
+func (bs *blockingService) GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	return bs.GetFile(ctx, filePath)
+}
+
+func (bs *blockingService) GetFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*s3.GetObjectOutput, error) {
+	_, _, err := bs.GetFile(ctx, filePath)
+	return nil, err
+}
+
+func (bs *blockingService) GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error) {
+	return bs.GetFile(ctx, filePath)
+}
+
+func TestSharesFetchBetweenConcurrentRequests(t *testing.T) {
+	fileService := &blockingService{release: make(chan struct{})}
+	service := New(fileService)
+
+	requestCount := 100
+	var finished sync.WaitGroup
+	finished.Add(requestCount)
+
+	errs := make([]error, requestCount)
+	for i := 0; i < requestCount; i++ {
+		go func(i int) {
+			_, _, errs[i] = service.GetFile(context.Background(), "a1b2c3/0.0.1/main.js")
+			finished.Done()
+		}(i)
+	}
+
+	for service.waiterCount("a1b2c3/0.0.1/main.js") < requestCount-1 {
+		// wait for all the requests to wait for the first fetch
+		runtime.Gosched()
+	}
+	close(fileService.release)
+	finished.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fileService.fetchCount), "fetches must be shared")
+	for _, err := range errs {
+		assert.Equal(t, fs.ErrorFileNotFound, err, "error must be shared")
+	}
+}
+
+// cancelableService returns the context error if the context is done before the release channel is closed
+type cancelableService struct {
+	blockingService
+}
+
+func (cs *cancelableService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	atomic.AddInt32(&cs.fetchCount, 1)
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-cs.release:
+		return nil, nil, fs.ErrorFileNotFound
+	}
+}
+
+func TestFetchesAgainWhenFetchingCallerIsCanceled(t *testing.T) {
+	fileService := &cancelableService{blockingService{release: make(chan struct{})}}
+	service := New(fileService)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, _, err := service.GetFile(ctx, "a1b2c3/0.0.1/main.js")
+		canceled <- err
+	}()
+	for atomic.LoadInt32(&fileService.fetchCount) == 0 {
+		// wait for the first fetch to start
+		runtime.Gosched()
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		_, _, err := service.GetFile(context.Background(), "a1b2c3/0.0.1/main.js")
+		finished <- err
+	}()
+	for service.waiterCount("a1b2c3/0.0.1/main.js") == 0 {
+		// wait for the second request to wait for the first fetch
+		runtime.Gosched()
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-canceled, "canceled caller must get the context error")
+	close(fileService.release)
+	assert.Equal(t, fs.ErrorFileNotFound, <-finished, "waiting caller must fetch the file again")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fileService.fetchCount), "file must be fetched again")
+}
+
+// panickingService panics while getting the files after the release channel is closed
+type panickingService struct {
+	blockingService
+}
+
+func (ps *panickingService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	atomic.AddInt32(&ps.fetchCount, 1)
+	<-ps.release
+	panic("fetch-failed")
+}
+
+func TestReleasesWaitersWhenFetchPanics(t *testing.T) {
+	fileService := &panickingService{blockingService{release: make(chan struct{})}}
+	service := New(fileService)
+
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			panicked <- recover()
+		}()
+		service.GetFile(context.Background(), "a1b2c3/0.0.1/main.js")
+	}()
+
+	for atomic.LoadInt32(&fileService.fetchCount) == 0 {
+		// wait for the first fetch to start
+		runtime.Gosched()
+	}
+
+	finished := make(chan error)
+	go func() {
+		_, _, err := service.GetFile(context.Background(), "a1b2c3/0.0.1/main.js")
+		finished <- err
+	}()
+
+	for service.waiterCount("a1b2c3/0.0.1/main.js") == 0 {
+		// wait for the second request to wait for the first fetch
+		runtime.Gosched()
+	}
+	close(fileService.release)
+
+	select {
+	case err := <-finished:
+		assert.Equal(t, errFetchPanicked, err, "waiters must be released with an error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiters must be released when the fetch panics")
+	}
+	assert.NotNil(t, <-panicked, "panic must be raised to the caller that fetches")
+}
@@ -0,0 +1,12 @@
+package coalescingfs
+
+// waiterCount returns the number of the callers waiting for the fetch in progress for the key
+func (cs *CoalescingService) waiterCount(key string) int {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if c, exists := cs.calls[key]; exists {
+		return c.waiters
+	}
+	return 0
+}
@@ -9,7 +9,54 @@ import (
 // ErrorFileNotFound used when the file is not found
 var ErrorFileNotFound = errors.New("file-not-found")
 
+// ErrorFileNotModified used when the file is not modified since the version known by the caller
+var ErrorFileNotModified = errors.New("file-not-modified")
+
+// ErrorFileTooLarge used when the file is larger than the size that can be read into the memory. The file meta
+// may be returned with the error to stream the file from its Body without requesting it again.
+var ErrorFileTooLarge = errors.New("file-too-large")
+
+// ErrorRangeNotSatisfiable used when the requested range of the file is not in the file
+var ErrorRangeNotSatisfiable = errors.New("range-not-satisfiable")
+
+// ErrorFileModified used when the file doesn't have the ETag known by the caller anymore
+var ErrorFileModified = errors.New("file-modified")
+
+// FileRange defines the part of the file requested with the HTTP Range and If-Range headers
+type FileRange struct {
+	// Range is the value of the Range header like 'bytes=0-1023'
+	Range string
+
+	// IfRange is the value of the If-Range header. The whole file is returned instead of the range
+	// if the file doesn't match it.
+	IfRange string
+}
+
 // IFileService defines the functionality of the file service
 type IFileService interface {
+	// GetFile returns the file with its content. If the file is too large to be read into the memory,
+	// ErrorFileTooLarge is returned with the file meta whose Body is open or with nil meta. The caller must
+	// stream or close the Body in that case.
 	GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error)
+
+	// GetFileIfModified returns the file if its ETag or last modification date is different than
+	// the given file meta's. Returns ErrorFileNotModified otherwise. The large files are returned like GetFile.
+	GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error)
+
+	// GetFileStream returns the file without reading its content. The content must be read from the Body
+	// of the returned file meta and the Body must be closed by the caller. Only the given range of the file
+	// is returned if the range is not nil, the ContentRange of the returned file meta is set in that case.
+	GetFileStream(ctx context.Context, filePath string, fileRange *FileRange) (*s3.GetObjectOutput, error)
+
+	// GetFilePart returns the bytes of the file from the start to the end, both inclusive. The ContentRange of
+	// the returned file meta contains the size of the whole file. If the ETag is not empty, the part is returned
+	// only if the file still has the ETag. Returns ErrorFileModified otherwise.
+	GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error)
+}
+
+// CloseBody closes the Body of the file meta if it has one
+func CloseBody(meta *s3.GetObjectOutput) {
+	if meta != nil && meta.Body != nil {
+		meta.Body.Close()
+	}
 }
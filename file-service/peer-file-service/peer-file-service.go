@@ -0,0 +1,300 @@
+package peerfs
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/config"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FilePath is the endpoint of the peers that serves the files they own
+	FilePath = "/_peer/file"
+
+	// PurgePath is the endpoint of the peers that removes the files from their caches
+	PurgePath = "/_peer/purge"
+
+	// KeyHeader is the header of the cluster key in the peer requests
+	KeyHeader = "peer-key"
+
+	// MetaHeader is the header of the file meta in the peer responses. The meta is encoded with EncodeMeta.
+	MetaHeader = "peer-file-meta"
+)
+
+// ErrorSelfNotInPeers used when the URL of the node is not in the peer list
+var ErrorSelfNotInPeers = errors.New("self-not-in-peers")
+
+// ErrorKeyMissing used when the cluster key is not configured. The peer endpoint serves any file in the file
+// server without checking the buckets, so it's never exposed without a key.
+var ErrorKeyMissing = errors.New("cluster-key-missing")
+
+// ErrorPurgingPeersFailed used when some of the peers fail to purge the files
+var ErrorPurgingPeersFailed = errors.New("purging-peers-failed")
+
+// peerRequestKey is the context key that marks the requests made by the peers
+type peerRequestKey struct{}
+
+// PeerService implements IFileService interface by getting the files from the peers that own them in the cluster.
+// Each file is owned by one peer by consistent hashing, so a file is fetched from the file server and cached by
+// its owner only. The files owned by this node, the streams and the files that the peers fail to return are
+// served by the underlying file service.
+type PeerService struct {
+	logger      *logrus.Logger
+	FileService fs.IFileService
+
+	// self is the URL of this node and peers are the URLs of all the nodes including this one
+	self  string
+	peers []string
+
+	// key is sent in the peer requests
+	key string
+
+	ring   *ring
+	client *http.Client
+
+	// backoff is how long a failed peer is skipped
+	backoff time.Duration
+
+	// lock guards failedAt, the last failure times of the peers
+	lock     sync.Mutex
+	failedAt map[string]time.Time
+}
+
+// New generates new PeerService
+func New(ctx context.Context, fileService fs.IFileService, clusterConfig config.Cluster) (*PeerService, error) {
+	logger, err := log.Of(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if clusterConfig.Key == "" {
+		return nil, ErrorKeyMissing
+	}
+
+	self := strings.TrimSuffix(clusterConfig.Self, "/")
+	peers := make([]string, len(clusterConfig.Peers))
+	hasSelf := false
+	for i, peer := range clusterConfig.Peers {
+		peers[i] = strings.TrimSuffix(strings.TrimSpace(peer), "/")
+		hasSelf = hasSelf || peers[i] == self
+	}
+	if !hasSelf {
+		return nil, ErrorSelfNotInPeers
+	}
+
+	return &PeerService{
+		logger:      logger,
+		FileService: fileService,
+		self:        self,
+		peers:       peers,
+		key:         clusterConfig.Key,
+		ring:        newRing(peers),
+		client:      &http.Client{Timeout: clusterConfig.Timeout},
+		backoff:     clusterConfig.Backoff,
+		failedAt:    map[string]time.Time{},
+	}, nil
+}
+
+// WithPeerRequest returns the context of a request made by a peer. The files are not forwarded to the other
+// peers in this context to prevent the loops between the peers that have different peer lists.
+func WithPeerRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peerRequestKey{}, true)
+}
+
+// Authorize returns the handler that rejects the peer requests that don't have the key. All the requests are
+// rejected if the key is empty.
+func Authorize(key string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(KeyHeader)), []byte(key)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// EncodeMeta encodes the file meta to be sent in the MetaHeader
+func EncodeMeta(meta *s3.GetObjectOutput) (string, error) {
+	metaContent, err := cache.MarshalMeta(meta)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(metaContent), nil
+}
+
+// DecodeMeta decodes the file meta encoded by EncodeMeta
+func DecodeMeta(encoded string) (*s3.GetObjectOutput, error) {
+	metaContent, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return cache.UnmarshalMeta(metaContent)
+}
+
+// GetFile implements IFileService interface
+func (ps *PeerService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	return ps.getFile(ctx, filePath, nil, func() (*s3.GetObjectOutput, []byte, error) {
+		return ps.FileService.GetFile(ctx, filePath)
+	})
+}
+
+// GetFileIfModified implements IFileService interface
+func (ps *PeerService) GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	return ps.getFile(ctx, filePath, knownMeta, func() (*s3.GetObjectOutput, []byte, error) {
+		return ps.FileService.GetFileIfModified(ctx, filePath, knownMeta)
+	})
+}
+
+// GetFileStream implements IFileService interface. The streams are not shared with the peers.
+func (ps *PeerService) GetFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*s3.GetObjectOutput, error) {
+	return ps.FileService.GetFileStream(ctx, filePath, fileRange)
+}
+
+// GetFilePart implements IFileService interface. The parts are not shared with the peers.
+func (ps *PeerService) GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error) {
+	return ps.FileService.GetFilePart(ctx, filePath, start, end, eTag)
+}
+
+// getFile gets the file from its owner peer. The file is fetched locally if it's owned by this node, the request
+// is made by a peer or the owner fails or has failed recently.
+func (ps *PeerService) getFile(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput, fetchLocally func() (*s3.GetObjectOutput, []byte, error)) (*s3.GetObjectOutput, []byte, error) {
+	owner := ps.ring.get(filePath)
+	if owner == ps.self || ctx.Value(peerRequestKey{}) != nil || ps.isBackingOff(owner) {
+		return fetchLocally()
+	}
+
+	fileMeta, fileContent, err := ps.getFileFromPeer(ctx, owner, filePath, knownMeta)
+	switch err {
+	case nil, fs.ErrorFileNotFound, fs.ErrorFileNotModified, fs.ErrorFileTooLarge:
+		return fileMeta, fileContent, err
+	}
+	if ctx.Err() != nil {
+		// the request is canceled, the peer hasn't failed
+		return nil, nil, ctx.Err()
+	}
+
+	ps.lock.Lock()
+	ps.failedAt[owner] = time.Now()
+	ps.lock.Unlock()
+
+	ps.logger.WithFields(logrus.Fields{
+		"peer":  owner,
+		"path":  filePath,
+		"error": err.Error(),
+	}).Warn("getting-file-from-peer-failed")
+	return fetchLocally()
+}
+
+// PurgePeers removes the files from the caches of the other peers. The owners serve their cached copies to the
+// peers, so the files purged only on this node would be served back by their owners. All the peers are tried
+// even if some of them fail.
+func (ps *PeerService) PurgePeers(ctx context.Context, path string, isPrefix bool) error {
+	query := url.Values{"path": {path}}
+	if isPrefix {
+		query.Set("prefix", "true")
+	}
+
+	var failedPeers []string
+	for _, peer := range ps.peers {
+		if peer == ps.self {
+			continue
+		}
+		if err := ps.purgePeer(ctx, peer, query); err != nil {
+			ps.logger.WithFields(logrus.Fields{
+				"peer":  peer,
+				"path":  path,
+				"error": err.Error(),
+			}).Warn("purging-peer-failed")
+			failedPeers = append(failedPeers, peer)
+		}
+	}
+
+	if len(failedPeers) > 0 {
+		return ErrorPurgingPeersFailed
+	}
+	return nil
+}
+
+func (ps *PeerService) purgePeer(ctx context.Context, peer string, query url.Values) error {
+	req, err := http.NewRequest(http.MethodPost, peer+PurgePath+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(KeyHeader, ps.key)
+
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer-responded-with-status-%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// isBackingOff returns true if the peer has failed within the backoff duration
+func (ps *PeerService) isBackingOff(peer string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	failedAt, hasFailed := ps.failedAt[peer]
+	return hasFailed && time.Since(failedAt) < ps.backoff
+}
+
+func (ps *PeerService) getFileFromPeer(ctx context.Context, peer, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, peer+FilePath+"?path="+url.QueryEscape(filePath), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(KeyHeader, ps.key)
+	if knownMeta != nil && knownMeta.ETag != nil {
+		req.Header.Set("If-None-Match", aws.StringValue(knownMeta.ETag))
+	}
+
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil, fs.ErrorFileNotFound
+	case http.StatusNotModified:
+		return nil, nil, fs.ErrorFileNotModified
+	case http.StatusRequestEntityTooLarge:
+		return nil, nil, fs.ErrorFileTooLarge
+	default:
+		return nil, nil, fmt.Errorf("peer-responded-with-status-%d", resp.StatusCode)
+	}
+
+	fileMeta, err := DecodeMeta(resp.Header.Get(MetaHeader))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileContent, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fileMeta, fileContent, nil
+}
@@ -0,0 +1,193 @@
+package peerfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devingen/api-core/log"
+	"github.com/devingen/sepet-cdn/config"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// localService returns the same content for all the files
+type localService struct {
+	fetchCount int
+}
+
+func (ls *localService) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
+	ls.fetchCount++
+	return &s3.GetObjectOutput{ETag: aws.String("local")}, []byte("local"), nil
+}
+
+func (ls *localService) GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	return ls.GetFile(ctx, filePath)
+}
+
+func (ls *localService) GetFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*s3.GetObjectOutput, error) {
+	return nil, fs.ErrorFileNotFound
+}
+
+func (ls *localService) GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error) {
+	return nil, nil, fs.ErrorFileNotFound
+}
+
+// newPeer returns a peer that serves the same content for all the files
+func newPeer(key string) *httptest.Server {
+	return httptest.NewServer(Authorize(key, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"peer"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		encodedMeta, _ := EncodeMeta(&s3.GetObjectOutput{ETag: aws.String(`"peer"`)})
+		w.Header().Set(MetaHeader, encodedMeta)
+		w.Write([]byte("peer:" + r.URL.Query().Get("path")))
+	}))
+}
+
+func newTestService(t *testing.T, local *localService, peerURL, key string) *PeerService {
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	service, err := New(ctx, local, config.Cluster{
+		Peers:   []string{"http://self", peerURL},
+		Self:    "http://self",
+		Key:     key,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// findPathOwnedBy returns a file path that's owned by the peer
+func findPathOwnedBy(service *PeerService, peer string) string {
+	for i := 0; ; i++ {
+		path := fmt.Sprintf("a1b2c3/0.0.1/file-%d.js", i)
+		if service.ring.get(path) == peer {
+			return path
+		}
+	}
+}
+
+func TestGetsFilesFromOwnerPeer(t *testing.T) {
+	peer := newPeer("secret")
+	defer peer.Close()
+
+	local := &localService{}
+	service := newTestService(t, local, peer.URL, "secret")
+
+	peerPath := findPathOwnedBy(service, peer.URL)
+	meta, content, err := service.GetFile(context.Background(), peerPath)
+	assert.Nil(t, err, "file must be returned")
+	assert.Equal(t, "peer:"+peerPath, string(content), "file must be returned by the owner")
+	assert.Equal(t, `"peer"`, aws.StringValue(meta.ETag), "meta must be returned by the owner")
+
+	_, _, err = service.GetFileIfModified(context.Background(), peerPath, meta)
+	assert.Equal(t, fs.ErrorFileNotModified, err, "owner must check the ETag")
+
+	selfPath := findPathOwnedBy(service, "http://self")
+	_, content, _ = service.GetFile(context.Background(), selfPath)
+	assert.Equal(t, "local", string(content), "own files must be fetched locally")
+
+	_, content, _ = service.GetFile(WithPeerRequest(context.Background()), peerPath)
+	assert.Equal(t, "local", string(content), "peer requests must not be forwarded")
+	assert.Equal(t, 2, local.fetchCount, "incorrect local fetch count")
+}
+
+func TestFetchesLocallyWhenPeerFails(t *testing.T) {
+	peer := newPeer("other-secret")
+	defer peer.Close()
+
+	local := &localService{}
+	service := newTestService(t, local, peer.URL, "secret")
+
+	_, content, err := service.GetFile(context.Background(), findPathOwnedBy(service, peer.URL))
+	assert.Nil(t, err, "file must be returned")
+	assert.Equal(t, "local", string(content), "file must be fetched locally when the peer rejects the request")
+
+	peer.Close()
+	_, content, err = service.GetFile(context.Background(), findPathOwnedBy(service, peer.URL))
+	assert.Nil(t, err, "file must be returned")
+	assert.Equal(t, "local", string(content), "file must be fetched locally when the peer is down")
+}
+
+func TestSkipsFailedPeerDuringBackoff(t *testing.T) {
+	requestCount := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer peer.Close()
+
+	local := &localService{}
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	service, err := New(ctx, local, config.Cluster{
+		Peers:   []string{"http://self", peer.URL},
+		Self:    "http://self",
+		Key:     "secret",
+		Timeout: time.Second,
+		Backoff: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerPath := findPathOwnedBy(service, peer.URL)
+	service.GetFile(context.Background(), peerPath)
+	_, content, err := service.GetFile(context.Background(), peerPath)
+	assert.Nil(t, err, "file must be returned")
+	assert.Equal(t, "local", string(content), "file must be fetched locally")
+	assert.Equal(t, 1, requestCount, "failed peer must be skipped")
+	assert.Equal(t, 2, local.fetchCount, "incorrect local fetch count")
+}
+
+func TestPurgesOtherPeers(t *testing.T) {
+	var purgeQueries []string
+	peer := httptest.NewServer(Authorize("secret", func(w http.ResponseWriter, r *http.Request) {
+		purgeQueries = append(purgeQueries, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer peer.Close()
+
+	service := newTestService(t, &localService{}, peer.URL, "secret")
+	err := service.PurgePeers(context.Background(), "a1b2c3/0.0.1/", true)
+	assert.Nil(t, err, "purge must succeed")
+	assert.Equal(t, []string{"POST " + PurgePath + "?path=a1b2c3%2F0.0.1%2F&prefix=true"}, purgeQueries, "purge must be sent to the other peers only")
+
+	peer.Close()
+	err = service.PurgePeers(context.Background(), "a1b2c3/0.0.1/app.js", false)
+	assert.Equal(t, ErrorPurgingPeersFailed, err, "failed peers must be reported")
+}
+
+func TestRejectsConfigWithoutSelf(t *testing.T) {
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	_, err := New(ctx, &localService{}, config.Cluster{Peers: []string{"http://10.0.0.1"}, Self: "http://10.0.0.2", Key: "secret"})
+	assert.Equal(t, ErrorSelfNotInPeers, err, "incorrect error")
+}
+
+func TestRejectsConfigWithoutKey(t *testing.T) {
+	ctx := log.WithLogger(context.Background(), logrus.New())
+	_, err := New(ctx, &localService{}, config.Cluster{Peers: []string{"http://10.0.0.1"}, Self: "http://10.0.0.1"})
+	assert.Equal(t, ErrorKeyMissing, err, "incorrect error")
+}
+
+func TestRejectsAllPeerRequestsWithoutKey(t *testing.T) {
+	peer := newPeer("")
+	defer peer.Close()
+
+	for _, key := range []string{"", "secret"} {
+		req, _ := http.NewRequest(http.MethodGet, peer.URL+FilePath+"?path=a1b2c3/0.0.1/index.html", nil)
+		req.Header.Set(KeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "request must be rejected without the key")
+	}
+}
@@ -0,0 +1,55 @@
+package peerfs
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of the points of each peer on the ring. More points distribute the files
+// more evenly between the peers.
+const ringReplicas = 50
+
+// ring maps the files to the peers by consistent hashing. Adding or removing a peer changes the owners
+// of only the files around the peer's points on the ring.
+type ring struct {
+	// hashes are the points of the peers on the ring in ascending order
+	hashes []uint32
+
+	// peers maps the points to the peers
+	peers map[uint32]string
+}
+
+func newRing(peers []string) *ring {
+	r := &ring{
+		hashes: make([]uint32, 0, len(peers)*ringReplicas),
+		peers:  map[uint32]string{},
+	}
+	for _, peer := range peers {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			r.hashes = append(r.hashes, hash)
+			r.peers[hash] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// get returns the peer that owns the key. The owner is the peer of the first point after the key's hash.
+func (r *ring) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	index := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if index == len(r.hashes) {
+		index = 0
+	}
+	return r.peers[r.hashes[index]]
+}
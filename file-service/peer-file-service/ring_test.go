@@ -0,0 +1,39 @@
+package peerfs
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDistributesKeysBetweenPeers(t *testing.T) {
+	peers := []string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"}
+	r := newRing(peers)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("a1b2c3/0.0.1/file-%d.js", i)
+		owner := r.get(key)
+		assert.Equal(t, owner, newRing(peers).get(key), "owner must be the same for the same peers")
+		counts[owner]++
+	}
+
+	for _, peer := range peers {
+		assert.True(t, counts[peer] > 500, "peer must own a fair share of the keys: "+peer)
+	}
+}
+
+func TestMovesFewKeysWhenPeerIsAdded(t *testing.T) {
+	before := newRing([]string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"})
+	after := newRing([]string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3", "http://10.0.0.4"})
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("a1b2c3/0.0.1/file-%d.js", i)
+		if before.get(key) != after.get(key) {
+			assert.Equal(t, "http://10.0.0.4", after.get(key), "keys must move only to the new peer")
+			moved++
+		}
+	}
+	assert.True(t, moved < 1500, "only a part of the keys must move")
+}
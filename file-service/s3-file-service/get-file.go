@@ -2,28 +2,153 @@ package s3fs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	fs "github.com/devingen/sepet-cdn/file-service"
 	"io/ioutil"
+	"net/http"
+	"strings"
 )
 
+// errPreconditionFailed used when the condition of the request like If-Match fails
+var errPreconditionFailed = errors.New("precondition-failed")
+
 // GetFile implements IFileService interface
 func (s3Service S3Service) GetFile(ctx context.Context, filePath string) (*s3.GetObjectOutput, []byte, error) {
-	sess := session.New(s3Service.Config)
-	s3Client := s3.New(sess, s3Service.Config)
+	return s3Service.getFile(ctx, &s3.GetObjectInput{Bucket: aws.String(s3Service.Bucket), Key: aws.String(filePath)})
+}
+
+// GetFileIfModified implements IFileService interface
+func (s3Service S3Service) GetFileIfModified(ctx context.Context, filePath string, knownMeta *s3.GetObjectOutput) (*s3.GetObjectOutput, []byte, error) {
+	return s3Service.getFile(ctx, &s3.GetObjectInput{
+		Bucket:          aws.String(s3Service.Bucket),
+		Key:             aws.String(filePath),
+		IfNoneMatch:     knownMeta.ETag,
+		IfModifiedSince: knownMeta.LastModified,
+	})
+}
+
+// GetFileStream implements IFileService interface. S3 doesn't support the If-Range header, so the condition is
+// sent as If-Match for the ETags and If-Unmodified-Since for the dates. The whole file is returned if the
+// condition fails.
+func (s3Service S3Service) GetFileStream(ctx context.Context, filePath string, fileRange *fs.FileRange) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{Bucket: aws.String(s3Service.Bucket), Key: aws.String(filePath)}
+	if fileRange == nil || !setRange(input, fileRange) {
+		return s3Service.getObject(ctx, input)
+	}
+
+	fileMeta, err := s3Service.getObject(ctx, input)
+	if err == errPreconditionFailed {
+		// the file is modified after the client got the other parts of it
+		return s3Service.getObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s3Service.Bucket), Key: aws.String(filePath)})
+	}
+	return fileMeta, err
+}
+
+// GetFilePart implements IFileService interface
+func (s3Service S3Service) GetFilePart(ctx context.Context, filePath string, start, end int64, eTag string) (*s3.GetObjectOutput, []byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3Service.Bucket),
+		Key:    aws.String(filePath),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	}
+	if eTag != "" {
+		input.IfMatch = aws.String(eTag)
+	}
 
-	// try to get the file
-	fileMeta, err := s3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(s3Service.Bucket), Key: aws.String(filePath)})
+	fileMeta, fileContent, err := s3Service.getFile(ctx, input)
+	if err == errPreconditionFailed {
+		return nil, nil, fs.ErrorFileModified
+	}
+	if err == fs.ErrorFileTooLarge {
+		// the parts are not streamed
+		fs.CloseBody(fileMeta)
+		return nil, nil, err
+	}
+	return fileMeta, fileContent, err
+}
+
+// setRange sets the range and the range condition of the input. Returns false if the range must be ignored
+// because the If-Range header can't be evaluated like the weak ETags.
+func setRange(input *s3.GetObjectInput, fileRange *fs.FileRange) bool {
+	ifRange := fileRange.IfRange
+	switch {
+	case ifRange == "":
+	case strings.HasPrefix(ifRange, "\""):
+		input.IfMatch = aws.String(ifRange)
+	default:
+		date, err := http.ParseTime(ifRange)
+		if err != nil {
+			return false
+		}
+		input.IfUnmodifiedSince = &date
+	}
+
+	input.Range = aws.String(fileRange.Range)
+	return true
+}
+
+// getFile gets the file and reads its content. Returns ErrorFileTooLarge without reading the content
+// if the file is larger than the buffer limit. The file meta is returned with its Body open in that case
+// to stream the file without requesting it again.
+func (s3Service S3Service) getFile(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, []byte, error) {
+	fileMeta, err := s3Service.getObject(ctx, input)
 	if err != nil {
-		return nil, nil, fs.ErrorFileNotFound
+		return nil, nil, err
+	}
+
+	if s3Service.MaxBufferBytes > 0 && aws.Int64Value(fileMeta.ContentLength) > s3Service.MaxBufferBytes {
+		return fileMeta, nil, fs.ErrorFileTooLarge
 	}
+	defer fileMeta.Body.Close()
 
 	fileContent, err := ioutil.ReadAll(fileMeta.Body)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
 		return nil, nil, err
 	}
 
 	return fileMeta, fileContent, nil
 }
+
+// getObject gets the object from S3. The request and the reading of the Body are canceled when the context is
+// done, the context error is returned in that case.
+func (s3Service S3Service) getObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	sess := session.New(s3Service.Config)
+	s3Client := s3.New(sess, s3Service.Config)
+
+	// the SDK version doesn't have GetObjectWithContext, the context is given to the HTTP request instead
+	req, fileMeta := s3Client.GetObjectRequest(input)
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	if err := req.Send(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, convertError(err)
+	}
+	return fileMeta, nil
+}
+
+// convertError returns ErrorFileNotFound if the error means the file doesn't exist. S3 returns
+// 403 instead of 404 for the missing files if the client doesn't have the permission to list the bucket.
+func convertError(err error) error {
+	if requestFailure, ok := err.(awserr.RequestFailure); ok {
+		switch requestFailure.StatusCode() {
+		case http.StatusNotFound, http.StatusForbidden:
+			return fs.ErrorFileNotFound
+		case http.StatusNotModified:
+			return fs.ErrorFileNotModified
+		case http.StatusPreconditionFailed:
+			return errPreconditionFailed
+		case http.StatusRequestedRangeNotSatisfiable:
+			return fs.ErrorRangeNotSatisfiable
+		}
+	}
+	return err
+}
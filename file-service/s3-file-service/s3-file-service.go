@@ -10,15 +10,20 @@ import (
 type S3Service struct {
 	Bucket string
 	Config *aws.Config
+
+	// MaxBufferBytes is the size limit of the files read into the memory by GetFile. Larger files must
+	// be streamed with GetFileStream. There is no limit if it's 0.
+	MaxBufferBytes int64
 }
 
 // New generates new S3Service
-func New(envConfig config.S3) S3Service {
+func New(envConfig config.S3, maxBufferBytes int64) S3Service {
 
 	if envConfig.Endpoint != "" {
 		// configure to use MinIO Server
 		return S3Service{
-			Bucket: envConfig.Bucket,
+			Bucket:         envConfig.Bucket,
+			MaxBufferBytes: maxBufferBytes,
 			Config: &aws.Config{
 				Credentials:      credentials.NewStaticCredentials(envConfig.AccessKeyID, envConfig.AccessKey, ""),
 				Endpoint:         aws.String(envConfig.Endpoint),
@@ -30,7 +35,8 @@ func New(envConfig config.S3) S3Service {
 	}
 
 	return S3Service{
-		Bucket: envConfig.Bucket,
+		Bucket:         envConfig.Bucket,
+		MaxBufferBytes: maxBufferBytes,
 		Config: &aws.Config{
 			Credentials: credentials.NewStaticCredentials(envConfig.AccessKeyID, envConfig.AccessKey, ""),
 			Endpoint:    aws.String(envConfig.Endpoint),
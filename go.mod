@@ -5,6 +5,7 @@ go 1.12
 //replace github.com/devingen/api-core => ../api-core
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/aws/aws-sdk-go v1.0.0
 	github.com/devingen/api-core v0.0.21
 	github.com/go-ini/ini v1.62.0 // indirect
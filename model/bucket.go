@@ -28,6 +28,14 @@ type Bucket struct {
 	// Domain of the bucket used in the URL. E.g. 'acme' for 'acme.sepet.devingen.io'
 	Domain *string `json:"domain,omitempty" bson:"domain,omitempty"`
 
+	// Hostnames are the full custom hostnames of the bucket. E.g. 'www.acme.com' and 'acme.com' to serve the
+	//   bucket from the custom domain that points to the CDN.
+	Hostnames *[]string `json:"hostnames,omitempty" bson:"hostnames,omitempty"`
+
+	// Aliases are the other domains of the bucket used in the URL like the Domain. E.g. 'acme-app' for
+	//   'acme-app.sepet.devingen.io'
+	Aliases *[]string `json:"aliases,omitempty" bson:"aliases,omitempty"`
+
 	// Region of the bucket for caching the files in the proper CDN region.
 	Region *string `json:"region,omitempty" bson:"region,omitempty"`
 
@@ -63,6 +71,16 @@ type Bucket struct {
 	//   that's fetched frequently.
 	IsCacheEnabled *bool `json:"isCacheEnabled,omitempty" bson:"isCacheEnabled,omitempty"`
 
+	// CacheMaxBytes is the total size limit of the bucket's files in the CDN cache. The least recently used files
+	//   of the bucket are evicted when the limit is exceeded, the files of the other buckets are not affected.
+	//   The bucket shares the cache limit of the CDN if it's not set.
+	CacheMaxBytes *int64 `json:"cacheMaxBytes,omitempty" bson:"cacheMaxBytes,omitempty"`
+
+	// IsPrecompressedFilesEnabled is used by CDN to serve the precompressed siblings of the files like 'app.js.br'
+	//   and 'app.js.gz' for 'app.js' to the clients that accept Brotli or gzip encoding. The file is served as is
+	//   if it doesn't have a precompressed sibling.
+	IsPrecompressedFilesEnabled *bool `json:"isPrecompressedFilesEnabled,omitempty" bson:"isPrecompressedFilesEnabled,omitempty"`
+
 	// IsVersioningEnabled is used by API and CDN to allow requests with specific versions.
 	IsVersioningEnabled *bool `json:"isVersioningEnabled,omitempty" bson:"isVersioningEnabled,omitempty"`
 
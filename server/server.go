@@ -3,10 +3,20 @@ package server
 import (
 	"context"
 	"github.com/devingen/api-core/log"
+	"github.com/devingen/api-core/wrapper"
+	"github.com/devingen/sepet-cdn/cache"
+	"github.com/devingen/sepet-cdn/cache/filediskcache"
 	"github.com/devingen/sepet-cdn/cache/filemapcache"
+	"github.com/devingen/sepet-cdn/cache/tieredcache"
 	"github.com/devingen/sepet-cdn/config"
+	admincont "github.com/devingen/sepet-cdn/controller/admin-controller"
+	healthcont "github.com/devingen/sepet-cdn/controller/health-controller"
 	srvcont "github.com/devingen/sepet-cdn/controller/service-controller"
+	webhookcont "github.com/devingen/sepet-cdn/controller/webhook-controller"
 	"github.com/devingen/sepet-cdn/dal/dalcache"
+	fs "github.com/devingen/sepet-cdn/file-service"
+	coalescingfs "github.com/devingen/sepet-cdn/file-service/coalescing-file-service"
+	peerfs "github.com/devingen/sepet-cdn/file-service/peer-file-service"
 	s3fs "github.com/devingen/sepet-cdn/file-service/s3-file-service"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -14,8 +24,8 @@ import (
 	"net/http"
 )
 
-// New creates a new HTTP server
-func New(appConfig config.App) *http.Server {
+// New creates a new HTTP server. The returned function must be called after the server is shut down.
+func New(appConfig config.App) (*http.Server, func()) {
 
 	ctx := context.Background()
 
@@ -27,28 +37,114 @@ func New(appConfig config.App) *http.Server {
 
 	srv := &http.Server{Addr: ":" + appConfig.Port}
 
-	fileCache, err := filemapcache.New(ctx, appConfig.CacheResetInterval)
+	memoryCache, err := filemapcache.New(ctx, appConfig.Cache)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	dal, err := dalcache.New(ctx, fileCache, appConfig.ApiURL, appConfig.ApiKey, appConfig.DalUpdateInterval)
+	var fileCache cache.IFileCache = memoryCache
+	var diskCache *filediskcache.FileDiskCache
+	if appConfig.Cache.DiskDir != "" {
+		// the files on the disk are revalidated as often as the memory cache is reset
+		diskCache, err = filediskcache.New(ctx, appConfig.Cache.DiskDir, appConfig.Cache.DiskMaxBytes, appConfig.Cache.ResetInterval)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		// look up the disk when the file is not in the memory
+		fileCache = tieredcache.New(memoryCache, diskCache)
+	}
+
+	dal, err := dalcache.New(ctx, fileCache, appConfig.ApiURL, appConfig.ApiKey, appConfig.RootDomains, appConfig.DalBackupFile, appConfig.DalUpdateInterval)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if diskCache != nil {
+		// the buckets may be changed while the server is down
+		diskCache.RemoveFilesOfChangedBuckets(dal.GetBuckets())
+	}
+
+	if appConfig.Cache.SnapshotDir != "" {
+		// the snapshot is loaded after the bucket list to skip the files of the removed buckets and versions
+		err = memoryCache.LoadSnapshot(appConfig.Cache.SnapshotDir, dal.GetBuckets())
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("loading-cache-snapshot-failed")
+		}
+	}
+
+	var fileService fs.IFileService = s3fs.New(appConfig.S3, appConfig.Cache.MaxObjectBytes)
+	var peerPurger admincont.IPeerPurger
+	if len(appConfig.Cluster.Peers) > 0 {
+		// get the files from the peers that own them
+		peerService, err := peerfs.New(ctx, fileService, appConfig.Cluster)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		fileService = peerService
+		peerPurger = peerService
+	}
+
+	// share the fetches of the same file between the concurrent requests
+	fileService = coalescingfs.New(fileService)
+	serviceController, err := srvcont.New(ctx, dal, fileCache, fileService, appConfig.Cache, appConfig.Compression)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	fileService := s3fs.New(appConfig.S3)
-	serviceController, err := srvcont.New(ctx, dal, fileCache, fileService)
+	if appConfig.AdminApiKey != "" {
+		adminController, err := admincont.New(ctx, dal, fileCache, memoryCache, peerPurger, appConfig.AdminApiKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		http.HandleFunc("/_admin/purge", wrapper.WithHTTPHandler(ctx, adminController.Purge))
+		http.HandleFunc("/_admin/cache/stats", wrapper.WithHTTPHandler(ctx, adminController.GetCacheStats))
+	}
+
+	healthController, err := healthcont.New(ctx, dal)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	http.HandleFunc("/_health", wrapper.WithHTTPHandler(ctx, healthController.GetHealth))
+
+	if appConfig.WebhookApiKey != "" {
+		webhookController, err := webhookcont.New(ctx, dal, appConfig.WebhookApiKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		http.HandleFunc("/_webhook/buckets", wrapper.WithHTTPHandler(ctx, webhookController.UpdateBucket))
+	}
+
+	if len(appConfig.Cluster.Peers) > 0 {
+		http.HandleFunc(peerfs.FilePath, peerfs.Authorize(appConfig.Cluster.Key, serviceController.GetPeerFile))
+		http.HandleFunc(peerfs.PurgePath, peerfs.Authorize(appConfig.Cluster.Key, serviceController.PurgePeerFiles))
+	}
 
 	router := mux.NewRouter()
 	wrappedHandler := apmhttp.Wrap(http.HandlerFunc(serviceController.GetFile))
 	router.HandleFunc("/{filePath}", wrappedHandler.ServeHTTP).Methods(http.MethodGet)
 
 	http.HandleFunc("/", serviceController.GetFile)
-	return srv
+
+	onShutdown := func() {
+		// the buckets are not updated while the cache is saved
+		dal.Close()
+
+		if appConfig.Cache.SnapshotDir == "" {
+			return
+		}
+		err := memoryCache.SaveSnapshot(appConfig.Cache.SnapshotDir, dal.GetBuckets())
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("saving-cache-snapshot-failed")
+		}
+	}
+	return srv, onShutdown
 }
 
 func getLogContext(ctx context.Context, level string) (context.Context, *logrus.Logger) {